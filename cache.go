@@ -0,0 +1,151 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/storage"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	cacheHits   = expvar.NewMap("cache_hits")
+	cacheMisses = expvar.NewMap("cache_misses")
+)
+
+// fileHash returns the hex encoded SHA-256 of a file's content
+func fileHash(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cachedOCR returns the cached OCR text of a file, the hash is stored on the job for later stages.
+// A hash taken by the cleanup stage is kept, it is the hash of the file before pages were removed.
+func cachedOCR(db *sql.DB, pc *PipelineContext) (string, bool, error) {
+	hash := pc.Artifact("sha256")
+	if hash == "" {
+		var err error
+		hash, err = fileHash(pc.Job.LocalFile)
+		if err != nil {
+			return "", false, err
+		}
+		pc.SetArtifact("sha256", hash)
+	}
+
+	entry, err := storage.GetCacheEntry(db, hash)
+	if err != nil {
+		return "", false, err
+	}
+
+	if entry == nil || entry.OCR == "" {
+		cacheMisses.Add("ocr", 1)
+		return "", false, nil
+	}
+
+	cacheHits.Add("ocr", 1)
+	pc.Logger.Info("Cache hit", "kind", "ocr", "hash", hash)
+	return entry.OCR, true, nil
+}
+
+// cachedClassification returns the cached classification of a file and its model if it was produced by the prompt and one of the models
+func cachedClassification(db *sql.DB, pc *PipelineContext, p prompt, models ...string) (storage.Classification, string, bool, error) {
+	hash := pc.Artifact("sha256")
+	if hash == "" {
+		return storage.Classification{}, "", false, nil
+	}
+
+	entry, err := storage.GetCacheEntry(db, hash)
+	if err != nil {
+		return storage.Classification{}, "", false, err
+	}
+
+	if entry == nil || entry.Classification == nil || entry.PromptVersion != p.Version() || !slices.Contains(models, entry.Model) {
+		cacheMisses.Add("classification", 1)
+		return storage.Classification{}, "", false, nil
+	}
+
+	cacheHits.Add("classification", 1)
+	pc.Logger.Info("Cache hit", "kind", "classification", "hash", hash, "prompt_version", entry.PromptVersion, "model", entry.Model)
+	return *entry.Classification, entry.Model, true, nil
+}
+
+var cacheCommand = &cli.Command{
+	Name:  "cache",
+	Usage: "Manage the OCR and classification cache",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "invalidate",
+			Usage:     "Remove cache entries by file or SHA-256 hash",
+			ArgsUsage: "[file or hash...]",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "all",
+					Usage: "Remove all cache entries",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() == 0 && !c.Bool("all") {
+					return fmt.Errorf("no file or hash provided, use --all to clear the whole cache")
+				}
+
+				err := loadConfig()
+				if err != nil {
+					return err
+				}
+
+				db, err := storage.OpenDB(viperDatabase())
+				if err != nil {
+					slog.Error("Error opening database", "error", err)
+					return err
+				}
+				defer db.Close()
+
+				if c.Bool("all") {
+					n, err := storage.InvalidateCache(db, "")
+					if err != nil {
+						return err
+					}
+					slog.Info("Invalidated cache", "entries", n)
+					return nil
+				}
+
+				for _, arg := range c.Args().Slice() {
+					hash := arg
+					if _, err := os.Stat(arg); err == nil {
+						hash, err = fileHash(arg)
+						if err != nil {
+							slog.Error("Error hashing file", "file", arg, "error", err)
+							return err
+						}
+					}
+
+					n, err := storage.InvalidateCache(db, hash)
+					if err != nil {
+						return err
+					}
+					slog.Info("Invalidated cache", "hash", hash, "entries", n)
+				}
+
+				return nil
+			},
+		},
+	},
+}
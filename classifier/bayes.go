@@ -0,0 +1,238 @@
+// Package classifier is an offline text classifier, TF-IDF weighted multinomial naive Bayes
+// trained on already classified documents
+package classifier
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Example is a labelled document
+type Example struct {
+	Text     string
+	Category string
+}
+
+// Model is a trained classifier, it is persisted as JSON
+type Model struct {
+	Categories []string       `json:"categories"`
+	Vocabulary map[string]int `json:"vocabulary"`
+	IDF        []float64      `json:"idf"`
+	// LogPrior is log P(category), LogLikelihood log P(term | category)
+	LogPrior      []float64   `json:"log_prior"`
+	LogLikelihood [][]float64 `json:"log_likelihood"`
+	Documents     int         `json:"documents"`
+	TrainedAt     time.Time   `json:"trained_at"`
+}
+
+// Prediction is the most likely category and its posterior probability
+type Prediction struct {
+	Category   string
+	Confidence float64
+}
+
+// Tokenize splits text into lowercase words. Single characters and pure numbers carry little
+// meaning for the category and are dropped.
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	tokens := words[:0]
+	for _, word := range words {
+		if len([]rune(word)) < 2 || strings.IndexFunc(word, unicode.IsLetter) < 0 {
+			continue
+		}
+		tokens = append(tokens, word)
+	}
+
+	return tokens
+}
+
+func termFrequencies(tokens []string) map[string]float64 {
+	tf := make(map[string]float64)
+	for _, token := range tokens {
+		tf[token]++
+	}
+	return tf
+}
+
+// Train builds a model from labelled examples. Term counts are replaced by their log-scaled
+// TF-IDF weights, which works much better than raw counts for long OCR texts.
+func Train(examples []Example) (*Model, error) {
+	if len(examples) == 0 {
+		return nil, errors.New("no training examples")
+	}
+
+	categoryIndex := make(map[string]int)
+	var categories []string
+	for _, example := range examples {
+		if _, ok := categoryIndex[example.Category]; !ok {
+			categoryIndex[example.Category] = len(categories)
+			categories = append(categories, example.Category)
+		}
+	}
+	if len(categories) < 2 {
+		return nil, fmt.Errorf("need at least two categories, got %d", len(categories))
+	}
+
+	documents := make([]map[string]float64, len(examples))
+	documentFrequency := make(map[string]int)
+	for i, example := range examples {
+		documents[i] = termFrequencies(Tokenize(example.Text))
+		for term := range documents[i] {
+			documentFrequency[term]++
+		}
+	}
+
+	// terms that appear in a single document are mostly OCR noise, names and numbers
+	minDocumentFrequency := 1
+	if len(examples) >= 20 {
+		minDocumentFrequency = 2
+	}
+
+	var terms []string
+	for term, df := range documentFrequency {
+		if df >= minDocumentFrequency {
+			terms = append(terms, term)
+		}
+	}
+	sort.Strings(terms)
+
+	m := &Model{
+		Categories:    categories,
+		Vocabulary:    make(map[string]int, len(terms)),
+		IDF:           make([]float64, len(terms)),
+		LogPrior:      make([]float64, len(categories)),
+		LogLikelihood: make([][]float64, len(categories)),
+		Documents:     len(examples),
+		TrainedAt:     time.Now(),
+	}
+	for i, term := range terms {
+		m.Vocabulary[term] = i
+		m.IDF[i] = math.Log(float64(1+len(examples))/float64(1+documentFrequency[term])) + 1
+	}
+
+	weights := make([][]float64, len(categories))
+	for c := range weights {
+		weights[c] = make([]float64, len(terms))
+	}
+
+	counts := make([]int, len(categories))
+	for i, example := range examples {
+		c := categoryIndex[example.Category]
+		counts[c]++
+		for term, weight := range m.weights(documents[i]) {
+			weights[c][term] += weight
+		}
+	}
+
+	// Laplace smoothing
+	const alpha = 1.0
+	for c := range categories {
+		m.LogPrior[c] = math.Log(float64(counts[c]) / float64(len(examples)))
+
+		var total float64
+		for _, w := range weights[c] {
+			total += w
+		}
+
+		m.LogLikelihood[c] = make([]float64, len(terms))
+		for t, w := range weights[c] {
+			m.LogLikelihood[c][t] = math.Log((w + alpha) / (total + alpha*float64(len(terms))))
+		}
+	}
+
+	return m, nil
+}
+
+// weights returns the L2 normalized, log-scaled TF-IDF weights of the known terms of a document
+func (m *Model) weights(tf map[string]float64) map[int]float64 {
+	weights := make(map[int]float64)
+	var norm float64
+	for term, count := range tf {
+		i, ok := m.Vocabulary[term]
+		if !ok {
+			continue
+		}
+		w := (1 + math.Log(count)) * m.IDF[i]
+		weights[i] = w
+		norm += w * w
+	}
+
+	norm = math.Sqrt(norm)
+	for i := range weights {
+		weights[i] /= norm
+	}
+
+	return weights
+}
+
+// Predict returns the most likely category of a text. The confidence is the posterior
+// probability, naive Bayes tends to be overconfident so thresholds should be high.
+func (m *Model) Predict(text string) Prediction {
+	weights := m.weights(termFrequencies(Tokenize(text)))
+
+	scores := make([]float64, len(m.Categories))
+	best := 0
+	for c := range m.Categories {
+		scores[c] = m.LogPrior[c]
+		for t, w := range weights {
+			scores[c] += w * m.LogLikelihood[c][t]
+		}
+		if scores[c] > scores[best] {
+			best = c
+		}
+	}
+
+	// softmax relative to the best score to avoid underflow
+	var sum float64
+	for _, score := range scores {
+		sum += math.Exp(score - scores[best])
+	}
+
+	return Prediction{
+		Category:   m.Categories[best],
+		Confidence: 1 / sum,
+	}
+}
+
+// Save writes the model to a file
+func (m *Model) Save(path string) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a running daemon never reads half a model
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to write model: %w", err)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Load reads a model written by Save
+func Load(path string) (*Model, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Model
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse model: %w", err)
+	}
+
+	return &m, nil
+}
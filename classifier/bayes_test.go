@@ -0,0 +1,135 @@
+package classifier
+
+import (
+	"math"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+var examples = []Example{
+	{Text: "Techniker Krankenkasse Beitrag Krankenversicherung Versichertenkarte", Category: "insurance"},
+	{Text: "Krankenkasse Beitragsbescheinigung Versicherung Pflegeversicherung", Category: "insurance"},
+	{Text: "Versicherung Police Haftpflicht Beitrag Versicherungsschein", Category: "insurance"},
+	{Text: "Sparkasse Kontoauszug Girokonto Überweisung Saldo", Category: "bank"},
+	{Text: "Kontoauszug Bank Lastschrift Saldo Dispositionskredit", Category: "bank"},
+	{Text: "Sparkasse Kreditkarte Abrechnung Konto Zinsen", Category: "bank"},
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "Sehr geehrte Frau Müller,", want: []string{"sehr", "geehrte", "frau", "müller"}},
+		// single characters and pure numbers are dropped, words with digits are kept
+		{text: "a 2024 B2B 12,50 €", want: []string{"b2b"}},
+		{text: "Kranken-\nversicherung", want: []string{"kranken", "versicherung"}},
+		{text: "", want: nil},
+	}
+
+	for _, test := range tests {
+		got := Tokenize(test.text)
+		if len(got) != len(test.want) || (len(got) > 0 && !slices.Equal(got, test.want)) {
+			t.Errorf("Tokenize(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestTrainErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		examples []Example
+	}{
+		{name: "no examples"},
+		{name: "one category", examples: []Example{{Text: "Kontoauszug", Category: "bank"}, {Text: "Saldo", Category: "bank"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Train(test.examples)
+			if err == nil {
+				t.Error("trained without enough examples")
+			}
+		})
+	}
+}
+
+func TestPredict(t *testing.T) {
+	m, err := Train(examples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "Ihre Krankenkasse: neuer Beitrag zur Pflegeversicherung", want: "insurance"},
+		{text: "Kontoauszug Nr. 5 der Sparkasse, Saldo alt und neu", want: "bank"},
+	}
+
+	for _, test := range tests {
+		p := m.Predict(test.text)
+		if p.Category != test.want {
+			t.Errorf("Predict(%q) = %s, want %s", test.text, p.Category, test.want)
+		}
+		if p.Confidence <= 0.5 || p.Confidence > 1 {
+			t.Errorf("Predict(%q) confidence = %.2f", test.text, p.Confidence)
+		}
+	}
+
+	// without known words the priors decide and the model is unsure
+	if p := m.Predict("Lorem ipsum"); p.Confidence != 0.5 {
+		t.Errorf("confidence without known words = %.2f, want 0.5", p.Confidence)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	m, err := Train(examples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "model.json")
+	err = m.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, example := range examples {
+		want, got := m.Predict(example.Text), loaded.Predict(example.Text)
+		// the weights are summed in map order, so the last digits differ
+		if got.Category != want.Category || math.Abs(got.Confidence-want.Confidence) > 1e-9 {
+			t.Errorf("loaded model predicts %+v for %q, want %+v", got, example.Text, want)
+		}
+	}
+	if report := Evaluate(loaded, examples); report.Accuracy != 1 {
+		t.Errorf("accuracy on the training examples = %.2f", report.Accuracy)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	train, test := Split(examples, 0.34, 1)
+
+	if len(train)+len(test) != len(examples) {
+		t.Fatalf("split %d examples into %d and %d", len(examples), len(train), len(test))
+	}
+	// every category is in both sets
+	for _, category := range []string{"insurance", "bank"} {
+		in := func(e Example) bool { return e.Category == category }
+		if !slices.ContainsFunc(train, in) || !slices.ContainsFunc(test, in) {
+			t.Errorf("category %s is missing from a set", category)
+		}
+	}
+
+	again, _ := Split(examples, 0.34, 1)
+	if !slices.Equal(train, again) {
+		t.Error("split with the same seed differs")
+	}
+}
@@ -0,0 +1,118 @@
+package classifier
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// CategoryReport holds the evaluation metrics of a single category
+type CategoryReport struct {
+	Category  string  `json:"category"`
+	Support   int     `json:"support"`
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+}
+
+// Report is the result of evaluating a model on labelled examples
+type Report struct {
+	Examples   int              `json:"examples"`
+	Correct    int              `json:"correct"`
+	Accuracy   float64          `json:"accuracy"`
+	Categories []CategoryReport `json:"categories"`
+	// Confusion counts predictions by expected and predicted category
+	Confusion map[string]map[string]int `json:"confusion"`
+}
+
+// Evaluate predicts every example and compares it to its label
+func Evaluate(m *Model, examples []Example) Report {
+	expected := make([]string, len(examples))
+	predicted := make([]string, len(examples))
+	for i, example := range examples {
+		expected[i] = example.Category
+		predicted[i] = m.Predict(example.Text).Category
+	}
+
+	return Compare(expected, predicted)
+}
+
+// Compare scores the predicted categories of any classifier against the expected ones
+func Compare(expected []string, predicted []string) Report {
+	report := Report{
+		Examples:  len(expected),
+		Confusion: make(map[string]map[string]int),
+	}
+
+	predictions := make(map[string]int)
+	support := make(map[string]int)
+	correct := make(map[string]int)
+
+	for i, e := range expected {
+		p := predicted[i]
+
+		if report.Confusion[e] == nil {
+			report.Confusion[e] = make(map[string]int)
+		}
+		report.Confusion[e][p]++
+
+		support[e]++
+		predictions[p]++
+		if p == e {
+			correct[e]++
+			report.Correct++
+		}
+	}
+
+	if len(expected) > 0 {
+		report.Accuracy = float64(report.Correct) / float64(len(expected))
+	}
+
+	for category, n := range support {
+		r := CategoryReport{
+			Category: category,
+			Support:  n,
+			Recall:   float64(correct[category]) / float64(n),
+		}
+		if predictions[category] > 0 {
+			r.Precision = float64(correct[category]) / float64(predictions[category])
+		}
+		report.Categories = append(report.Categories, r)
+	}
+	sort.Slice(report.Categories, func(i, j int) bool {
+		return report.Categories[i].Category < report.Categories[j].Category
+	})
+
+	return report
+}
+
+// Split shuffles the examples with a fixed seed and returns a training and a test set, the
+// test set gets the given fraction of every category
+func Split(examples []Example, testFraction float64, seed int64) (train []Example, test []Example) {
+	byCategory := make(map[string][]Example)
+	var categories []string
+	for _, example := range examples {
+		if _, ok := byCategory[example.Category]; !ok {
+			categories = append(categories, example.Category)
+		}
+		byCategory[example.Category] = append(byCategory[example.Category], example)
+	}
+	sort.Strings(categories)
+
+	r := rand.New(rand.NewSource(seed))
+	for _, category := range categories {
+		examples := byCategory[category]
+		r.Shuffle(len(examples), func(i, j int) {
+			examples[i], examples[j] = examples[j], examples[i]
+		})
+
+		n := int(float64(len(examples)) * testFraction)
+		// categories with a single example can only be trained on
+		if len(examples) > 1 {
+			n = max(n, 1)
+		}
+
+		test = append(test, examples[:n]...)
+		train = append(train, examples[n:]...)
+	}
+
+	return train, test
+}
@@ -0,0 +1,64 @@
+package classifier
+
+import (
+	"math"
+	"sort"
+)
+
+// Match is a document similar to a query
+type Match struct {
+	Index      int
+	Similarity float64
+}
+
+// MostSimilar returns the k documents most similar to the query by TF-IDF cosine similarity,
+// most similar first. Documents below minSimilarity are left out.
+func MostSimilar(query string, documents []string, k int, minSimilarity float64) []Match {
+	if k <= 0 || len(documents) == 0 {
+		return nil
+	}
+
+	tfs := make([]map[string]float64, len(documents)+1)
+	documentFrequency := make(map[string]int)
+	for i, text := range append([]string{query}, documents...) {
+		tfs[i] = termFrequencies(Tokenize(text))
+		for term := range tfs[i] {
+			documentFrequency[term]++
+		}
+	}
+
+	n := float64(len(tfs))
+	vector := func(tf map[string]float64) map[string]float64 {
+		v := make(map[string]float64, len(tf))
+		var norm float64
+		for term, count := range tf {
+			w := (1 + math.Log(count)) * (math.Log((1+n)/float64(1+documentFrequency[term])) + 1)
+			v[term] = w
+			norm += w * w
+		}
+		norm = math.Sqrt(norm)
+		for term := range v {
+			v[term] /= norm
+		}
+		return v
+	}
+
+	q := vector(tfs[0])
+
+	var matches []Match
+	for i, tf := range tfs[1:] {
+		var similarity float64
+		for term, w := range vector(tf) {
+			similarity += w * q[term]
+		}
+		if similarity >= minSimilarity && !math.IsNaN(similarity) {
+			matches = append(matches, Match{Index: i, Similarity: similarity})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Similarity > matches[j].Similarity
+	})
+
+	return matches[:min(k, len(matches))]
+}
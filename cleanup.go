@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Page cleanup runs before OCR, configured globally and per user:
+//
+//	cleanup:
+//	  remove_blank: true
+//	  blank_threshold: 0.005
+//	  rotate: true
+//	  deskew: true
+//	  clean: true
+//	users:
+//	  alice:
+//	    cleanup:
+//	      deskew: false
+//
+// Blank pages are removed by the cleanup stage, rotation, deskewing and cleaning are done by
+// ocrmypdf while the document is OCRed.
+
+// userKey returns the config key of a setting that users can override, e.g. "cleanup.rotate" or
+// "users.alice.cleanup.rotate"
+func userKey(user string, setting string) string {
+	key := fmt.Sprintf("users.%s.%s", user, setting)
+	if user != "" && viper.IsSet(key) {
+		return key
+	}
+	return setting
+}
+
+// ocrOptions change the pages while they are OCRed
+type ocrOptions struct {
+	// Rotate turns pages upright using tesseract's orientation detection
+	Rotate bool
+	Deskew bool
+	// Clean removes scanner noise before OCR, the pages are not changed by it
+	Clean bool
+}
+
+func cleanupOptions(user string) ocrOptions {
+	return ocrOptions{
+		Rotate: viper.GetBool(userKey(user, "cleanup.rotate")),
+		Deskew: viper.GetBool(userKey(user, "cleanup.deskew")),
+		Clean:  viper.GetBool(userKey(user, "cleanup.clean")),
+	}
+}
+
+// changesPages reports whether the OCRed PDF differs from the scan and should replace it
+func (o ocrOptions) changesPages() bool {
+	return o.Rotate || o.Deskew
+}
+
+func (o ocrOptions) args() []string {
+	// --redo-ocr keeps the text layer of vector pages but can't be combined with deskewing
+	args := []string{"--redo-ocr"}
+	if o.Deskew {
+		args = []string{"--force-ocr", "--deskew"}
+	}
+	if o.Rotate {
+		args = append(args, "--rotate-pages")
+	}
+	if o.Clean {
+		args = append(args, "--clean")
+	}
+	return args
+}
+
+// rotatedPagePattern matches ocrmypdf's log lines of pages it turned, e.g.
+// "   3 page is facing ⇩, confidence 12.35 - rotation appears to be 180"
+var rotatedPagePattern = regexp.MustCompile(`(?m)^\s*(\d+)\s+page is facing .* - (?:rotation appears|will rotate)`)
+
+// rotatedPages returns the pages ocrmypdf turned according to its output
+func rotatedPages(output string) []int {
+	var pages []int
+	for _, match := range rotatedPagePattern.FindAllStringSubmatch(output, -1) {
+		if strings.Contains(match[0], "too low") {
+			continue
+		}
+		page, err := strconv.Atoi(match[1])
+		if err == nil {
+			pages = append(pages, page)
+		}
+	}
+	return pages
+}
+
+// cleanupReport is stored in the "cleanup" artifact
+type cleanupReport struct {
+	RemovedPages []int `json:"removed_pages,omitempty"`
+	RotatedPages []int `json:"rotated_pages,omitempty"`
+	Deskewed     bool  `json:"deskewed,omitempty"`
+	Cleaned      bool  `json:"cleaned,omitempty"`
+}
+
+func cleanupReportOf(pc *PipelineContext) cleanupReport {
+	var report cleanupReport
+	if a := pc.Artifact("cleanup"); a != "" {
+		err := json.Unmarshal([]byte(a), &report)
+		if err != nil {
+			pc.Logger.Warn("Invalid cleanup artifact", "error", err)
+		}
+	}
+	return report
+}
+
+func (r cleanupReport) save(pc *PipelineContext) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		pc.Logger.Warn("Error encoding cleanup report", "error", err)
+		return
+	}
+	pc.SetArtifact("cleanup", string(b))
+}
+
+// keepPages writes the given pages of a PDF to a new file
+func keepPages(ctx context.Context, file string, pages []int, output string) error {
+	list := make([]string, len(pages))
+	for i, page := range pages {
+		list[i] = strconv.Itoa(page)
+	}
+
+	_, err := runLocal(interactionPages, file, output, func(i *interaction) error {
+		i.Pages = pages
+		out, err := exec.CommandContext(ctx, "gs", "-q", "-o", output, "-sDEVICE=pdfwrite", "-sPageList="+strings.Join(list, ","), file).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("unable to remove pages: %w: %s", err, out)
+		}
+		return nil
+	})
+	return err
+}
+
+// cleanupStage removes blank pages before OCR. The hash of the file is taken first, so the OCR
+// cache and duplicate detection see the scan as it was downloaded.
+func cleanupStage(db *sql.DB, pc *PipelineContext) error {
+	user := pc.Job.User
+
+	if pc.Artifact("sha256") == "" {
+		hash, err := fileHash(pc.Job.LocalFile)
+		if err != nil {
+			return err
+		}
+		pc.SetArtifact("sha256", hash)
+	}
+
+	// a retry must not remove pages of the already cleaned file
+	if !viper.GetBool(userKey(user, "cleanup.remove_blank")) || pc.Artifact("cleanup") != "" {
+		return nil
+	}
+
+	viper.SetDefault("cleanup.blank_threshold", 0.005)
+
+	coverage, err := inkCoverage(pc.Context, pc.Job.LocalFile)
+	if err != nil {
+		return err
+	}
+
+	var report cleanupReport
+	var keep []int
+	for i, c := range coverage {
+		if c < viper.GetFloat64(userKey(user, "cleanup.blank_threshold")) {
+			report.RemovedPages = append(report.RemovedPages, i+1)
+		} else {
+			keep = append(keep, i+1)
+		}
+	}
+
+	// a scan that is blank altogether is left alone, OCR and the user will notice
+	if len(report.RemovedPages) > 0 && len(keep) > 0 {
+		output := pc.Job.LocalFile + ".cleaned"
+		err := keepPages(pc.Context, pc.Job.LocalFile, keep, output)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(output, pc.Job.LocalFile)
+		if err != nil {
+			return err
+		}
+
+		pc.Logger.Info("Removed blank pages", "pages", report.RemovedPages)
+	} else {
+		report.RemovedPages = nil
+	}
+
+	report.save(pc)
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// errUnsupportedFile is returned for files that can't be turned into a PDF, they are not retried
+var errUnsupportedFile = errors.New("unsupported file type")
+
+// fileType is the format of an input file as detected by sniffFile
+type fileType string
+
+const (
+	typePDF  fileType = "pdf"
+	typeJPEG fileType = "jpeg"
+	typePNG  fileType = "png"
+	typeTIFF fileType = "tiff"
+	typeHEIC fileType = "heic"
+)
+
+// sniffFile detects the type of a file by its magic bytes, the name of scans can't be relied on
+func sniffFile(file string) (fileType, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 32)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	header = header[:n]
+
+	switch {
+	// the PDF header may be preceded by garbage, which readers accept
+	case bytes.Contains(header, []byte("%PDF-")):
+		return typePDF, nil
+	case bytes.HasPrefix(header, []byte{0xff, 0xd8, 0xff}):
+		return typeJPEG, nil
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return typePNG, nil
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		return typeTIFF, nil
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		switch string(header[8:12]) {
+		case "heic", "heix", "heim", "heis", "mif1", "msf1":
+			return typeHEIC, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %q", errUnsupportedFile, header[:min(len(header), 8)])
+}
+
+// imageToPDF converts an image to a PDF. img2pdf embeds JPEGs without recompressing them, uses
+// the DPI of the image for the page size, applies the EXIF orientation and turns every page of
+// a TIFF into a page of the PDF.
+func imageToPDF(ctx context.Context, file string, t fileType, output string) error {
+	_, err := runLocal(interactionConvert, file, output, func(*interaction) error {
+		return convertImage(ctx, file, t, output)
+	})
+	return err
+}
+
+func convertImage(ctx context.Context, file string, t fileType, output string) error {
+	dir, err := os.MkdirTemp("", "ai-scan-classifier-convert")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	input := file
+	if t == typeHEIC {
+		// img2pdf can't read HEIC, heif-convert applies the orientation while converting
+		input = filepath.Join(dir, "image.jpg")
+		out, err := exec.CommandContext(ctx, "heif-convert", "-q", "95", file, input).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("unable to convert HEIC image: %w: %s", err, out)
+		}
+	}
+
+	out, err := exec.CommandContext(ctx, "img2pdf", "--rotation=ifvalid", "-o", output, input).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to convert image to PDF: %w: %s", err, out)
+	}
+
+	return nil
+}
+
+// convertFile turns an image into a PDF in place and returns the detected type
+func convertFile(ctx context.Context, file string) (fileType, error) {
+	// replays have no file to sniff, the fixture records the type
+	sniff := sniffFile
+	if harness != nil && harness.replay {
+		sniff = harness.inputType
+	}
+
+	t, err := sniff(file)
+	if err != nil || t == typePDF {
+		return t, err
+	}
+
+	output := file + ".converted"
+	err = imageToPDF(ctx, file, t, output)
+	if err != nil {
+		return t, err
+	}
+
+	return t, os.Rename(output, file)
+}
+
+// convertStage converts images to PDF so that later stages and uploads only deal with PDFs. The
+// spool file is named .pdf whatever was downloaded.
+func convertStage(pc *PipelineContext) error {
+	// a retry must not convert the converted file again
+	if pc.Artifact("input_type") != "" {
+		return nil
+	}
+
+	t, err := convertFile(pc.Context, pc.Job.LocalFile)
+	if err != nil {
+		return err
+	}
+
+	if t != typePDF {
+		pc.Logger.Info("Converted image to PDF", "type", t)
+	}
+	pc.SetArtifact("input_type", string(t))
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/storage"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/spf13/viper"
+)
+
+// what happens with a document that is already in the archive
+const (
+	// duplicateSkip doesn't upload the document at all
+	duplicateSkip = "skip"
+	// duplicateFolder uploads the document to duplicatesFolder
+	duplicateFolder = "folder"
+	// duplicateAsk asks the user via Telegram
+	duplicateAsk = "ask"
+	// duplicateUpload is the answer for documents that turned out not to be duplicates
+	duplicateUpload = "upload"
+)
+
+// duplicatesFolder is prepended to the destination path of duplicates, Paperless gets it as a tag
+const duplicatesFolder = "_duplicates"
+
+// errWaitForUser is returned by stages that can only continue once the user answered a question
+var errWaitForUser = errors.New("waiting for the user to answer")
+
+// duplicateAction returns what to do with duplicates of a user, falling back to the global setting
+func duplicateAction(user string) string {
+	viper.SetDefault("duplicates.action", duplicateFolder)
+
+	key := fmt.Sprintf("users.%s.duplicates.action", user)
+	if viper.IsSet(key) {
+		return viper.GetString(key)
+	}
+	return viper.GetString("duplicates.action")
+}
+
+// findDuplicate looks for an earlier job of any user with the same file or a very similar OCR text
+func findDuplicate(db *sql.DB, job *storage.Job) (*storage.Job, float64, error) {
+	original, err := storage.FindJobByHash(db, job.Hash, job.ID)
+	if err != nil || original != nil {
+		return original, 1, err
+	}
+
+	if job.MinHash == "" {
+		return nil, 0, nil
+	}
+
+	viper.SetDefault("duplicates.threshold", 0.8)
+	threshold := viper.GetFloat64("duplicates.threshold")
+
+	signatures, err := storage.JobSignatures(db, job.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var best int64
+	var bestSimilarity float64
+	for id, signature := range signatures {
+		s := similarity(job.MinHash, signature)
+		if s >= threshold && (s > bestSimilarity || (s == bestSimilarity && id < best)) {
+			best, bestSimilarity = id, s
+		}
+	}
+
+	if best == 0 {
+		return nil, 0, nil
+	}
+
+	original, err = storage.GetJob(db, best)
+	return original, bestSimilarity, err
+}
+
+// dedupeStage detects documents that were already scanned by comparing the file hash and the
+// MinHash signature of the OCR text against the job history
+func dedupeStage(db *sql.DB, pc *PipelineContext) error {
+	job := pc.Job
+
+	// the user answered the question about this job
+	if action := pc.Artifact("duplicate_action"); action != "" {
+		return applyDuplicateAction(db, pc, action)
+	}
+
+	hash := pc.Artifact("sha256")
+	if hash == "" {
+		var err error
+		hash, err = fileHash(job.LocalFile)
+		if err != nil {
+			return err
+		}
+		pc.SetArtifact("sha256", hash)
+	}
+
+	job.Hash = hash
+	job.MinHash = minHash(job.OCR)
+
+	original, similarity, err := findDuplicate(db, job)
+	if err != nil {
+		return err
+	}
+	if original == nil {
+		return nil
+	}
+
+	job.DuplicateOf = original.ID
+	job.Similarity = similarity
+	pc.Logger.Info("Duplicate detected", "original", original.ID, "original_user", original.User, "original_file", original.File, "similarity", similarity)
+
+	action := duplicateAction(job.User)
+	if action == duplicateAsk {
+		if !telegramConfigured(job.User) {
+			pc.Logger.Warn("Telegram not configured, uploading duplicate to folder", "folder", duplicatesFolder)
+			return applyDuplicateAction(db, pc, duplicateFolder)
+		}
+
+		err = askAboutDuplicate(job, original)
+		if err != nil {
+			return err
+		}
+		return errWaitForUser
+	}
+
+	return applyDuplicateAction(db, pc, action)
+}
+
+func applyDuplicateAction(db *sql.DB, pc *PipelineContext, action string) error {
+	job := pc.Job
+
+	switch action {
+	case duplicateSkip:
+		original, err := storage.GetJob(db, job.DuplicateOf)
+		if err != nil {
+			return err
+		}
+
+		// the notification points to the original document
+		if original != nil {
+			job.Classification = original.Classification
+			job.Provider = original.Provider
+			job.Path = original.Path
+			job.URL = original.URL
+		}
+		job.Duplicate = true
+	case duplicateUpload:
+		job.DuplicateOf = 0
+		job.Similarity = 0
+	case duplicateFolder:
+	default:
+		return fmt.Errorf("unknown duplicate action %s", action)
+	}
+
+	pc.SetArtifact("duplicate_action", action)
+	return nil
+}
+
+func askAboutDuplicate(job *storage.Job, original *storage.Job) error {
+	id := strconv.FormatInt(job.ID, 10)
+	keyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("Skip").WithCallbackData("duplicate:"+id+":"+duplicateSkip),
+			tu.InlineKeyboardButton("Upload to "+duplicatesFolder).WithCallbackData("duplicate:"+id+":"+duplicateFolder),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("Not a duplicate").WithCallbackData("duplicate:"+id+":"+duplicateUpload),
+		),
+	)
+
+	return sendTelegramQuestion(job.User, fmt.Sprintf(`Possible duplicate: <code>%s</code>
+
+It is %.0f%% similar to <code>%s</code> scanned by %s on %s. What should I do?`,
+		html.EscapeString(job.File), job.Similarity*100, html.EscapeString(original.File), original.User, original.CreatedAt.Format("2006-01-02")), keyboard)
+}
+
+// answerDuplicate resumes a job that waits for the user to decide what to do with a duplicate
+func answerDuplicate(db *sql.DB, user string, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errors.New("invalid answer")
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return "", errors.New("invalid job id")
+	}
+
+	job, err := storage.GetJob(db, id)
+	if err != nil {
+		return "", err
+	}
+	if job == nil || job.User != user {
+		return "", errors.New("job not found")
+	}
+	if job.State != storage.JobWaiting {
+		return "Already answered", nil
+	}
+
+	switch args[1] {
+	case duplicateSkip, duplicateFolder, duplicateUpload:
+	default:
+		return "", fmt.Errorf("unknown action %s", args[1])
+	}
+
+	if job.Artifacts == nil {
+		job.Artifacts = make(map[string]string)
+	}
+	job.Artifacts["duplicate_action"] = args[1]
+	job.State = storage.JobPending
+
+	err = storage.UpdateJob(db, *job)
+	if err != nil {
+		return "", err
+	}
+
+	switch args[1] {
+	case duplicateSkip:
+		return "Skipping " + job.File, nil
+	case duplicateFolder:
+		return "Uploading " + job.File + " to " + duplicatesFolder, nil
+	default:
+		return "Uploading " + job.File, nil
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/classifier"
+	"3nt3/ai-scan-classifier/storage"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/urfave/cli/v2"
+)
+
+// evalOffline evaluates the offline classifier instead of an LLM
+const evalOffline = "offline"
+
+// evalDocument is a labelled document of the evaluation dataset
+type evalDocument struct {
+	labelledFile
+	Text string
+	Hash string
+}
+
+type evalPrediction struct {
+	File        string `json:"file"`
+	Expected    string `json:"expected"`
+	Predicted   string `json:"predicted"`
+	Explanation string `json:"explanation,omitempty"`
+	// Classifier is the classifier that decided in pipeline mode, see the "classifier" artifact
+	Classifier string  `json:"classifier,omitempty"`
+	Cost       float64 `json:"cost"`
+	Cached     bool    `json:"cached"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// evalResult is the evaluation of one model on the whole dataset
+type evalResult struct {
+	Model         string `json:"model"`
+	PromptVersion string `json:"prompt_version"`
+	// Pipeline is set if the documents were classified like the daemon does, see evalPipeline
+	Pipeline bool              `json:"pipeline,omitempty"`
+	Report   classifier.Report `json:"report"`
+	// Cost is what classifying the dataset costs, Spent what this run spent without the cached classifications
+	Cost        float64          `json:"cost"`
+	Spent       float64          `json:"spent"`
+	Cached      int              `json:"cached"`
+	Errors      int              `json:"errors"`
+	Predictions []evalPrediction `json:"predictions"`
+}
+
+// parallel calls fn for 0..n-1 on the given number of goroutines
+func parallel(concurrency int, n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+
+	for range max(concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := range n {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// evalDocuments reads and OCRs the labelled documents of a directory
+func evalDocuments(ctx context.Context, db *sql.DB, dir string, concurrency int) ([]evalDocument, error) {
+	files, err := labelledFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	documents := make([]evalDocument, len(files))
+	parallel(concurrency, len(files), func(i int) {
+		f := files[i]
+		documents[i].labelledFile = f
+
+		hash, err := fileHash(f.Path)
+		if err != nil {
+			slog.Warn("Skipping file that can't be read", "file", f.Path, "error", err)
+			return
+		}
+		documents[i].Hash = hash
+
+		text, err := f.text(ctx, db)
+		if err != nil {
+			slog.Warn("Skipping file that can't be OCRed", "file", f.Path, "error", err)
+			return
+		}
+		documents[i].Text = text
+	})
+
+	return slices.DeleteFunc(documents, func(d evalDocument) bool {
+		return d.Text == ""
+	}), nil
+}
+
+// evalClassify classifies a document with only the model and prompt, LLM classifications are cached per model and prompt
+func evalClassify(ctx context.Context, db *sql.DB, model string, p prompt, doc evalDocument, useCache bool) evalPrediction {
+	prediction := evalPrediction{File: doc.Path, Expected: doc.Category}
+
+	if model == evalOffline {
+		classification, _, ok := classifyOffline(filepath.Base(doc.Path), doc.Text)
+		if !ok {
+			prediction.Error = fmt.Sprintf("no offline classifier at %s", offlineModelPath())
+			return prediction
+		}
+		prediction.Predicted = classification.Category
+		prediction.Explanation = classification.Explanation
+		return prediction
+	}
+
+	if useCache {
+		entry, err := storage.GetEvalEntry(db, doc.Hash, model, p.Version())
+		if err != nil {
+			slog.Warn("Error reading eval cache", "error", err)
+		}
+		if entry != nil {
+			prediction.Predicted = entry.Classification.Category
+			prediction.Explanation = entry.Classification.Explanation
+			prediction.Cost = entry.Cost
+			prediction.Cached = true
+			return prediction
+		}
+	}
+
+	classification, usage, err := classifyText(ctx, model, doc.Text, promptContext{Prompt: p})
+	prediction.Cost = cost(model, usage)
+	if err != nil {
+		prediction.Error = err.Error()
+		return prediction
+	}
+	prediction.Predicted = classification.Category
+	prediction.Explanation = classification.Explanation
+
+	err = storage.CacheEval(db, doc.Hash, model, p.Version(), storage.EvalEntry{Classification: classification, Cost: prediction.Cost})
+	if err != nil {
+		slog.Warn("Error caching eval classification", "error", err)
+	}
+
+	return prediction
+}
+
+// evalPipeline classifies a document with classifyJob like the daemon classifies a job of the user,
+// but without the cache and without writing to the history. The results depend on the history, so
+// they are not cached either.
+func evalPipeline(ctx context.Context, db *sql.DB, model string, p prompt, doc evalDocument, user string) evalPrediction {
+	prediction := evalPrediction{File: doc.Path, Expected: doc.Category}
+
+	env := classifyEnv{
+		db:     db,
+		model:  model,
+		prompt: p.Name,
+		recordUsage: func(_ *storage.Job, model string, usage openai.Usage) {
+			prediction.Cost += cost(model, usage)
+		},
+	}
+
+	// the hash keeps documents of the history with the same content out of the k-NN vote and the examples
+	job := &storage.Job{User: user, File: filepath.Base(doc.Path), OCR: doc.Text, Hash: doc.Hash, Artifacts: map[string]string{}}
+	pc := &PipelineContext{Context: ctx, Job: job, Stage: "classify", Logger: slog.With("file", doc.Path)}
+
+	err := rulesStage(pc)
+	if err == nil {
+		err = classifyJob(env, pc)
+	}
+	if err != nil {
+		prediction.Error = err.Error()
+		return prediction
+	}
+
+	prediction.Predicted = job.Classification.Category
+	prediction.Explanation = job.Classification.Explanation
+	prediction.Classifier = pc.Artifact("classifier")
+	return prediction
+}
+
+// evaluate classifies all documents with a model and prompt and scores the predictions
+func evaluate(ctx context.Context, db *sql.DB, model string, p prompt, documents []evalDocument, concurrency int, useCache bool, pipeline bool, user string) evalResult {
+	result := evalResult{
+		Model:         model,
+		PromptVersion: p.ID(),
+		Pipeline:      pipeline,
+		Predictions:   make([]evalPrediction, len(documents)),
+	}
+	if model == evalOffline {
+		result.PromptVersion = ""
+		result.Pipeline = false
+	}
+
+	parallel(concurrency, len(documents), func(i int) {
+		if pipeline && model != evalOffline {
+			result.Predictions[i] = evalPipeline(ctx, db, model, p, documents[i], user)
+			return
+		}
+		result.Predictions[i] = evalClassify(ctx, db, model, p, documents[i], useCache)
+	})
+
+	var expected, predicted []string
+	for _, p := range result.Predictions {
+		result.Cost += p.Cost
+		if p.Cached {
+			result.Cached++
+		} else {
+			result.Spent += p.Cost
+		}
+
+		// failed classifications say nothing about the model
+		if p.Error != "" {
+			result.Errors++
+			continue
+		}
+		expected = append(expected, p.Expected)
+		predicted = append(predicted, p.Predicted)
+	}
+	result.Report = classifier.Compare(expected, predicted)
+
+	return result
+}
+
+func printConfusion(out io.Writer, confusion map[string]map[string]int) error {
+	var categories []string
+	for expected, row := range confusion {
+		categories = append(categories, expected)
+		for predicted := range row {
+			categories = append(categories, predicted)
+		}
+	}
+	slices.Sort(categories)
+	categories = slices.Compact(categories)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(w, "EXPECTED \\ PREDICTED\t")
+	for _, c := range categories {
+		fmt.Fprintf(w, "%s\t", c)
+	}
+	fmt.Fprintln(w)
+
+	for _, expected := range categories {
+		if confusion[expected] == nil {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t", expected)
+		for _, predicted := range categories {
+			fmt.Fprintf(w, "%d\t", confusion[expected][predicted])
+		}
+		fmt.Fprintln(w)
+	}
+
+	return w.Flush()
+}
+
+func printEvalText(out io.Writer, results []evalResult) error {
+	for _, result := range results {
+		fmt.Fprintf(out, "== %s", result.Model)
+		if result.PromptVersion != "" {
+			fmt.Fprintf(out, " (prompt %s)", result.PromptVersion)
+		}
+		if result.Pipeline {
+			fmt.Fprint(out, " (pipeline)")
+		}
+		fmt.Fprint(out, "\n\n")
+
+		err := printReport(out, result.Report)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(out)
+		err = printConfusion(out, result.Report.Confusion)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "\nMISCLASSIFIED\tEXPECTED\tPREDICTED\tEXPLANATION")
+		for _, p := range result.Predictions {
+			if p.Error == "" && p.Predicted != p.Expected {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.File, p.Expected, p.Predicted, p.Explanation)
+			}
+		}
+		for _, p := range result.Predictions {
+			if p.Error != "" {
+				fmt.Fprintf(w, "%s\t%s\terror\t%s\n", p.File, p.Expected, p.Error)
+			}
+		}
+		err = w.Flush()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "\nCost: $%.4f ($%.4f spent, %d cached, %d errors)\n\n", result.Cost, result.Spent, result.Cached, result.Errors)
+	}
+
+	if len(results) < 2 {
+		return nil
+	}
+
+	sorted := slices.Clone(results)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Report.Accuracy > sorted[j].Report.Accuracy
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tPROMPT\tACCURACY\tCORRECT\tERRORS\tCOST")
+	for _, result := range sorted {
+		fmt.Fprintf(w, "%s\t%s\t%.2f\t%d/%d\t%d\t$%.4f\n", result.Model, result.PromptVersion, result.Report.Accuracy,
+			result.Report.Correct, result.Report.Examples, result.Errors, result.Cost)
+	}
+
+	return w.Flush()
+}
+
+// printEvalCSV writes one row per model and document, the reports can be derived from them
+func printEvalCSV(out io.Writer, results []evalResult) error {
+	w := csv.NewWriter(out)
+	err := w.Write([]string{"model", "prompt_version", "file", "expected", "predicted", "correct", "cost", "cached", "error"})
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		for _, p := range result.Predictions {
+			err := w.Write([]string{
+				result.Model,
+				result.PromptVersion,
+				p.File,
+				p.Expected,
+				p.Predicted,
+				strconv.FormatBool(p.Error == "" && p.Predicted == p.Expected),
+				strconv.FormatFloat(p.Cost, 'f', -1, 64),
+				strconv.FormatBool(p.Cached),
+				p.Error,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+var evalCommand = &cli.Command{
+	Name:  "eval",
+	Usage: "Evaluate classifiers on a directory with one folder of documents per category",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "dir",
+			Usage:    "Directory with one folder of documents per category",
+			Required: true,
+		},
+		&cli.StringSliceFlag{
+			Name:  "model",
+			Usage: "Model to evaluate, repeat to compare models side by side. \"offline\" evaluates the offline classifier",
+			Value: cli.NewStringSlice(classificationModel),
+		},
+		&cli.StringSliceFlag{
+			Name:  "prompt",
+			Usage: "Prompt to evaluate, repeat to compare prompt versions side by side. Defaults to the configured prompt",
+		},
+		&cli.StringFlag{
+			Name:  "user",
+			Usage: "Render the prompts with the profile of this user, with --pipeline also use the user's rules and history",
+		},
+		&cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "Number of documents classified at the same time",
+			Value: 4,
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "Output format: text, json or csv",
+			Value: "text",
+		},
+		&cli.BoolFlag{
+			Name:  "pipeline",
+			Usage: "Classify like the daemon with the rules, classifier.mode, budget, experiment, k-NN vote and few-shot examples of --user instead of only the prompt",
+		},
+		&cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "Classify all documents again instead of using earlier results",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		format := c.String("format")
+		if !slices.Contains([]string{"text", "json", "csv"}, format) {
+			return fmt.Errorf("unknown format %q", format)
+		}
+
+		err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		db, err := storage.OpenDB(viperDatabase())
+		if err != nil {
+			slog.Error("Error opening database", "error", err)
+			return err
+		}
+		defer db.Close()
+
+		documents, err := evalDocuments(c.Context, db, c.String("dir"), c.Int("concurrency"))
+		if err != nil {
+			return err
+		}
+		if len(documents) == 0 {
+			return errors.New("no labelled documents found")
+		}
+		slog.Info("Loaded documents", "dir", c.String("dir"), "documents", len(documents))
+
+		promptNames := c.StringSlice("prompt")
+		if len(promptNames) == 0 {
+			promptNames = []string{defaultPromptName(c.String("user"))}
+		}
+		var prompts []prompt
+		for _, name := range promptNames {
+			p, err := loadPrompt(name, c.String("user"))
+			if err != nil {
+				return err
+			}
+			prompts = append(prompts, p)
+		}
+
+		var results []evalResult
+		for _, model := range c.StringSlice("model") {
+			for _, p := range prompts {
+				slog.Info("Evaluating", "model", model, "prompt", p.ID())
+				results = append(results, evaluate(c.Context, db, model, p, documents, c.Int("concurrency"), !c.Bool("no-cache"), c.Bool("pipeline"), c.String("user")))
+
+				// the offline classifier has no prompt
+				if model == evalOffline {
+					break
+				}
+			}
+		}
+
+		switch format {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(results)
+		case "csv":
+			return printEvalCSV(os.Stdout, results)
+		default:
+			return printEvalText(os.Stdout, results)
+		}
+	},
+}
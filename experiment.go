@@ -0,0 +1,318 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/storage"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/urfave/cli/v2"
+)
+
+// An experiment compares the current prompt and model (variant A) with a candidate (variant B).
+// A share of the documents is routed to B, or in shadow mode every document is classified by
+// both and only A's classification is used:
+//
+//	experiment:
+//	  prompt: classify-v2
+//	  model: gpt-4o
+//	  percentage: 10
+//	  shadow: false
+const (
+	variantA = "A"
+	variantB = "B"
+)
+
+// variant is a prompt and model that classify documents
+type variant struct {
+	Name   string
+	Prompt prompt
+	Model  string
+}
+
+// shadowResult is the classification of the shadow variant, stored in the "shadow" artifact
+type shadowResult struct {
+	Variant       string `json:"variant"`
+	Model         string `json:"model"`
+	PromptVersion string `json:"prompt_version"`
+	Category      string `json:"category"`
+	// Primary is the category of the variant that was used
+	Primary string `json:"primary"`
+}
+
+func experimentRunning() bool {
+	return viper.GetString("experiment.prompt") != "" || viper.GetString("experiment.model") != ""
+}
+
+// routedToB decides by the job id, so retries of a job stay in the same variant
+func routedToB(job *storage.Job) bool {
+	h := fnv.New32a()
+	fmt.Fprint(h, job.ID)
+	return int(h.Sum32()%100) < viper.GetInt("experiment.percentage")
+}
+
+// chooseVariant returns the variant that classifies a job and the variant that runs in its
+// shadow, if any. Jobs that are downgraded to a cheaper model by the budget stay out of the experiment.
+func chooseVariant(job *storage.Job, name string, model string) (variant, *variant, error) {
+	p, err := loadPrompt(name, job.User)
+	if err != nil {
+		return variant{}, nil, err
+	}
+	a := variant{Prompt: p, Model: model}
+
+	if !experimentRunning() || model != classificationModel {
+		return a, nil, nil
+	}
+	a.Name = variantA
+
+	p, err = loadPrompt(viper.GetString("experiment.prompt"), job.User)
+	if err != nil {
+		return variant{}, nil, err
+	}
+	b := variant{Name: variantB, Prompt: p, Model: viper.GetString("experiment.model")}
+	if b.Model == "" {
+		b.Model = model
+	}
+
+	if viper.GetBool("experiment.shadow") {
+		return a, &b, nil
+	}
+	if routedToB(job) {
+		return b, nil, nil
+	}
+	return a, nil, nil
+}
+
+// validatePrompts makes sure the configured prompts exist, render and use the profile for every
+// user. Documents of nobody use the global prompts, so they are validated without users too.
+func validatePrompts() error {
+	users := []string{""}
+	for user := range viper.GetStringMap("users") {
+		users = append(users, user)
+	}
+
+	names := []string{""}
+	if experimentRunning() {
+		names = append(names, viper.GetString("experiment.prompt"))
+	}
+
+	for _, user := range users {
+		for _, name := range names {
+			p, err := loadPrompt(name, user)
+			if err != nil {
+				return err
+			}
+
+			err = checkProfile(p, user)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// shadowClassify classifies a job with the shadow variant, the result is only recorded for the experiment report
+func shadowClassify(env classifyEnv, pc *PipelineContext, v variant, pctx promptContext, primary string) {
+	pctx.Prompt = v.Prompt
+
+	classification, usage, err := classifyText(pc.Context, v.Model, pc.Job.OCR, pctx)
+	if usage.TotalTokens > 0 {
+		env.recordUsage(pc.Job, v.Model, usage)
+	}
+	if err != nil {
+		pc.Logger.Warn("Error classifying in shadow mode", "variant", v.Name, "error", err)
+		return
+	}
+
+	b, err := json.Marshal(shadowResult{
+		Variant:       v.Name,
+		Model:         v.Model,
+		PromptVersion: v.Prompt.ID(),
+		Category:      classification.Category,
+		Primary:       primary,
+	})
+	if err != nil {
+		pc.Logger.Warn("Error encoding shadow classification", "error", err)
+		return
+	}
+
+	pc.Logger.Debug("Classified in shadow mode", "variant", v.Name, "category", classification.Category, "primary", primary)
+	pc.SetArtifact("shadow", string(b))
+}
+
+// variantStats sums up the jobs of a variant with one prompt version and model
+type variantStats struct {
+	Variant       string
+	PromptVersion string
+	Model         string
+	Documents     int
+	Confirmed     int
+	Corrected     int
+}
+
+// shadowStats compares the shadow classifications with the ones that were used
+type shadowStats struct {
+	Variant       string
+	PromptVersion string
+	Model         string
+	Compared      int
+	Agreed        int
+	// Confirmed counts the compared jobs with feedback, Correct those where the shadow category was right
+	Confirmed int
+	Correct   int
+}
+
+func rate(n, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", float64(n)/float64(total)*100)
+}
+
+func experimentReport(jobs []storage.Job) ([]variantStats, []shadowStats) {
+	variants := map[[3]string]*variantStats{}
+	shadows := map[[3]string]*shadowStats{}
+
+	for _, job := range jobs {
+		key := [3]string{job.Variant, job.PromptVersion, job.Model}
+		v, ok := variants[key]
+		if !ok {
+			v = &variantStats{Variant: job.Variant, PromptVersion: job.PromptVersion, Model: job.Model}
+			variants[key] = v
+		}
+		v.Documents++
+		if job.Confirmed {
+			v.Confirmed++
+			if job.Artifacts["classifier"] == "user" {
+				v.Corrected++
+			}
+		}
+
+		var shadow shadowResult
+		if job.Artifacts["shadow"] == "" || json.Unmarshal([]byte(job.Artifacts["shadow"]), &shadow) != nil {
+			continue
+		}
+
+		key = [3]string{shadow.Variant, shadow.PromptVersion, shadow.Model}
+		s, ok := shadows[key]
+		if !ok {
+			s = &shadowStats{Variant: shadow.Variant, PromptVersion: shadow.PromptVersion, Model: shadow.Model}
+			shadows[key] = s
+		}
+		s.Compared++
+		if shadow.Category == shadow.Primary {
+			s.Agreed++
+		}
+		if job.Confirmed {
+			s.Confirmed++
+			if shadow.Category == job.Classification.Category {
+				s.Correct++
+			}
+		}
+	}
+
+	var variantList []variantStats
+	for _, v := range variants {
+		variantList = append(variantList, *v)
+	}
+	sort.Slice(variantList, func(i, j int) bool {
+		a, b := variantList[i], variantList[j]
+		if a.Variant != b.Variant {
+			return a.Variant < b.Variant
+		}
+		if a.PromptVersion != b.PromptVersion {
+			return a.PromptVersion < b.PromptVersion
+		}
+		return a.Model < b.Model
+	})
+
+	var shadowList []shadowStats
+	for _, s := range shadows {
+		shadowList = append(shadowList, *s)
+	}
+	sort.Slice(shadowList, func(i, j int) bool {
+		a, b := shadowList[i], shadowList[j]
+		if a.PromptVersion != b.PromptVersion {
+			return a.PromptVersion < b.PromptVersion
+		}
+		return a.Model < b.Model
+	})
+
+	return variantList, shadowList
+}
+
+var experimentCommand = &cli.Command{
+	Name:  "experiment",
+	Usage: "Compare prompt versions and models",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "report",
+			Usage: "Show agreement and correction rates per variant",
+			Flags: []cli.Flag{
+				&cli.TimestampFlag{
+					Name:   "since",
+					Usage:  "Only include documents classified since this date",
+					Layout: time.DateOnly,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				err := loadConfig()
+				if err != nil {
+					return err
+				}
+
+				db, err := storage.OpenDB(viperDatabase())
+				if err != nil {
+					slog.Error("Error opening database", "error", err)
+					return err
+				}
+				defer db.Close()
+
+				var since time.Time
+				if t := c.Timestamp("since"); t != nil {
+					since = *t
+				}
+
+				jobs, err := storage.ExperimentJobs(db, since)
+				if err != nil {
+					return err
+				}
+
+				variants, shadows := experimentReport(jobs)
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "VARIANT\tPROMPT\tMODEL\tDOCUMENTS\tCONFIRMED\tCORRECTED\tCORRECTION RATE")
+				for _, v := range variants {
+					name := v.Variant
+					if name == "" {
+						name = "-"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n", name, v.PromptVersion, v.Model, v.Documents, v.Confirmed, v.Corrected, rate(v.Corrected, v.Confirmed))
+				}
+				err = w.Flush()
+				if err != nil {
+					return err
+				}
+
+				if len(shadows) == 0 {
+					return nil
+				}
+
+				w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "\nSHADOW\tPROMPT\tMODEL\tCOMPARED\tAGREEMENT\tCONFIRMED\tCORRECT")
+				for _, s := range shadows {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%d\t%s\n", s.Variant, s.PromptVersion, s.Model, s.Compared, rate(s.Agreed, s.Compared), s.Confirmed, rate(s.Correct, s.Confirmed))
+				}
+				return w.Flush()
+			},
+		},
+	},
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/classifier"
+	"3nt3/ai-scan-classifier/storage"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/spf13/viper"
+)
+
+// promptContext is added to the classification prompt
+type promptContext struct {
+	// Prompt is the classification prompt, the default prompt if empty
+	Prompt prompt
+	// Hints come from rules
+	Hints []string
+	// Examples are similar documents the user confirmed
+	Examples []fewShotExample
+	// Recipient asks for the addressee of the document, see routeStage
+	Recipient bool
+}
+
+type fewShotExample struct {
+	Category string
+	Title    string
+	Excerpt  string
+}
+
+// messages returns the prompt messages for the context
+func (p promptContext) messages() []string {
+	var messages []string
+
+	if len(p.Examples) > 0 {
+		var b strings.Builder
+		b.WriteString("Here are similar documents I classified before, together with their correct category:")
+		for i, example := range p.Examples {
+			fmt.Fprintf(&b, "\n\nExample %d (category: %s, title: %s):\n%s", i+1, example.Category, example.Title, example.Excerpt)
+		}
+		messages = append(messages, b.String())
+	}
+
+	if len(p.Hints) > 0 {
+		messages = append(messages, "Hints:\n- "+strings.Join(p.Hints, "\n- "))
+	}
+
+	if p.Recipient {
+		messages = append(messages, `Also give the name of the person the document is addressed to as "recipient" in the JSON, empty if unknown.`)
+	}
+
+	return messages
+}
+
+// fewShotExamples returns excerpts of the confirmed documents of a user that are most similar to
+// a job. They are read from the database for every job, so corrections apply immediately.
+func fewShotExamples(db *sql.DB, job *storage.Job) ([]fewShotExample, error) {
+	viper.SetDefault("few_shot.examples", 3)
+	viper.SetDefault("few_shot.excerpt_length", 500)
+	viper.SetDefault("few_shot.min_similarity", 0.1)
+
+	k := viper.GetInt("few_shot.examples")
+	if k <= 0 {
+		return nil, nil
+	}
+
+	jobs, err := storage.ConfirmedJobs(db, job.User)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []storage.Job
+	var texts []string
+	for _, confirmed := range jobs {
+		// a document must not be its own example, e.g. when it is evaluated
+		if confirmed.ID == job.ID || (job.Hash != "" && confirmed.Hash == job.Hash) {
+			continue
+		}
+		candidates = append(candidates, confirmed)
+		texts = append(texts, confirmed.OCR)
+	}
+
+	var examples []fewShotExample
+	for _, match := range classifier.MostSimilar(job.OCR, texts, k, viper.GetFloat64("few_shot.min_similarity")) {
+		candidate := candidates[match.Index]
+		excerpt := []rune(strings.Join(strings.Fields(candidate.OCR), " "))
+
+		examples = append(examples, fewShotExample{
+			Category: candidate.Classification.Category,
+			Title:    candidate.Classification.Title,
+			Excerpt:  string(excerpt[:min(len(excerpt), viper.GetInt("few_shot.excerpt_length"))]),
+		})
+	}
+
+	return examples, nil
+}
+
+// confirmKeyboard lets the user confirm or correct a classification
+func confirmKeyboard(job *storage.Job) *telego.InlineKeyboardMarkup {
+	id := strconv.FormatInt(job.ID, 10)
+
+	return tu.InlineKeyboard(tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton("Correct").WithCallbackData("confirm:"+id),
+		tu.InlineKeyboardButton("Change category").WithCallbackData("recategorize:"+id),
+	))
+}
+
+// userJob returns a job of a user from the id in a Telegram answer
+func userJob(db *sql.DB, user string, arg string) (*storage.Job, error) {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid job id")
+	}
+
+	job, err := storage.GetJob(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil || job.User != user {
+		return nil, errors.New("job not found")
+	}
+
+	return job, nil
+}
+
+// answerConfirm confirms the classification of a job
+func answerConfirm(db *sql.DB, user string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("invalid answer")
+	}
+
+	job, err := userJob(db, user, args[0])
+	if err != nil {
+		return "", err
+	}
+
+	_, err = storage.ConfirmJob(db, job.ID, "")
+	if err != nil {
+		return "", err
+	}
+
+	return "Thanks, confirmed " + job.Classification.Category, nil
+}
+
+// answerRecategorize asks the user for the correct category of a job
+func answerRecategorize(db *sql.DB, user string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("invalid answer")
+	}
+
+	job, err := userJob(db, user, args[0])
+	if err != nil {
+		return "", err
+	}
+
+	categories, err := storage.Categories(db, user)
+	if err != nil {
+		return "", err
+	}
+
+	var buttons []telego.InlineKeyboardButton
+	for _, category := range categories {
+		data := fmt.Sprintf("category:%d:%s", job.ID, category)
+		// Telegram limits callback data to 64 bytes
+		if category == job.Classification.Category || len(data) > 64 {
+			continue
+		}
+		buttons = append(buttons, tu.InlineKeyboardButton(category).WithCallbackData(data))
+	}
+	if len(buttons) == 0 {
+		return "", errors.New("no other categories known yet, use the API to correct the category")
+	}
+
+	err = sendTelegramQuestion(user, fmt.Sprintf("Which category is <b>%s</b>?", html.EscapeString(job.Classification.Title)), tu.InlineKeyboardGrid(tu.InlineKeyboardCols(3, buttons...)))
+	if err != nil {
+		return "", err
+	}
+
+	return "Pick the correct category", nil
+}
+
+// answerCategory corrects the category of a job
+func answerCategory(db *sql.DB, user string, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errors.New("invalid answer")
+	}
+
+	job, err := userJob(db, user, args[0])
+	if err != nil {
+		return "", err
+	}
+
+	_, err = storage.ConfirmJob(db, job.ID, args[1])
+	if err != nil {
+		return "", err
+	}
+
+	// the document is not moved, the correction is used for later classifications
+	return fmt.Sprintf("Changed category of %s to %s", job.File, args[1]), nil
+}
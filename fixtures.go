@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"3nt3/ai-scan-classifier/storage"
+
+	"github.com/spf13/viper"
+	"github.com/urfave/cli/v2"
+)
+
+// A fixture holds every external interaction of a run: OCR output, text layers and HTTP exchanges with OpenAI,
+// Telegram and the storage providers. It is written with --record and replayed with the replay
+// command, which runs the classification against the fixture without calling anything.
+type fixture struct {
+	Input        *fixtureInput `json:"input,omitempty"`
+	Interactions []interaction `json:"interactions"`
+	// Classification is the result of the recorded run, a replay has to produce the same
+	Classification *storage.Classification `json:"classification,omitempty"`
+}
+
+// fixtureInput describes the classified file, a replay doesn't need the file itself
+type fixtureInput struct {
+	Name string   `json:"name"`
+	Hash string   `json:"sha256"`
+	Type fileType `json:"type"`
+}
+
+// interaction is a single run of a local tool or HTTP exchange
+type interaction struct {
+	Kind string `json:"kind"`
+
+	// File and Text are the input and output of local tools like OCR
+	File string `json:"file,omitempty"`
+	Text string `json:"text,omitempty"`
+	// Usable is whether the text layer can replace OCR
+	Usable bool `json:"usable,omitempty"`
+	// Pages are the pages OCR turned upright
+	Pages []int `json:"pages,omitempty"`
+	// Coverage is the ink coverage of every page
+	Coverage []float64 `json:"coverage,omitempty"`
+
+	Request  *recordedRequest  `json:"request,omitempty"`
+	Response *recordedResponse `json:"response,omitempty"`
+
+	Error string `json:"error,omitempty"`
+
+	used bool
+}
+
+const (
+	interactionOCR       = "ocr"
+	interactionTextLayer = "text_layer"
+	interactionConvert   = "convert"
+	interactionCoverage  = "ink_coverage"
+	interactionPages     = "pages"
+	interactionHTTP      = "http"
+)
+
+type recordedRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+}
+
+type recordedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// fixtureHarness records or replays the interactions of a fixture
+type fixtureHarness struct {
+	mu      sync.Mutex
+	replay  bool
+	fixture fixture
+	base    http.RoundTripper
+	// problems are requests that could not be replayed
+	problems []string
+}
+
+// harness is the active harness, nil if nothing is recorded or replayed
+var harness *fixtureHarness
+
+// startHarness installs a harness for all HTTP requests and OCR runs
+func startHarness(f fixture, replay bool) *fixtureHarness {
+	h := &fixtureHarness{replay: replay, fixture: f, base: http.DefaultTransport}
+	harness = h
+	http.DefaultTransport = h
+	return h
+}
+
+func (h *fixtureHarness) stop() {
+	http.DefaultTransport = h.base
+	harness = nil
+}
+
+func (h *fixtureHarness) add(i interaction) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fixture.Interactions = append(h.fixture.Interactions, i)
+}
+
+func (h *fixtureHarness) problem(format string, args ...any) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	err := fmt.Errorf("replay: "+format, args...)
+	h.problems = append(h.problems, err.Error())
+	return err
+}
+
+// unused returns the recorded interactions that were not replayed
+func (h *fixtureHarness) unused() []interaction {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var unused []interaction
+	for _, i := range h.fixture.Interactions {
+		if !i.used {
+			unused = append(unused, i)
+		}
+	}
+	return unused
+}
+
+// redact removes secrets that are part of URLs, like the Telegram bot token
+func redact(s string) string {
+	if token := viper.GetString("telegram_token"); token != "" {
+		s = strings.ReplaceAll(s, token, "TELEGRAM_TOKEN")
+	}
+	return s
+}
+
+// recordedBody returns the comparable form of a request body. Multipart boundaries are random, so
+// those bodies are not compared, and binary bodies are stored as their hash.
+func recordedBody(contentType string, body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return ""
+	case utf8.Valid(body):
+		return redact(string(body))
+	default:
+		sum := sha256.Sum256(body)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+}
+
+// firstDifference shows where two strings start to differ
+func firstDifference(expected, actual string) string {
+	i := 0
+	for i < len(expected) && i < len(actual) && expected[i] == actual[i] {
+		i++
+	}
+
+	excerpt := func(s string) string {
+		start := max(i-40, 0)
+		end := min(i+40, len(s))
+		return strings.ToValidUTF8(s[start:end], "")
+	}
+
+	return fmt.Sprintf("at byte %d, recorded %q, got %q", i, excerpt(expected), excerpt(actual))
+}
+
+func (h *fixtureHarness) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	recorded := &recordedRequest{
+		Method: req.Method,
+		URL:    redact(req.URL.String()),
+		Body:   recordedBody(req.Header.Get("Content-Type"), body),
+	}
+
+	if h.replay {
+		return h.replayHTTP(req, recorded)
+	}
+
+	i := interaction{Kind: interactionHTTP, Request: recorded}
+	resp, err := h.base.RoundTrip(req)
+	if err != nil {
+		i.Error = err.Error()
+		h.add(i)
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	header := resp.Header.Clone()
+	header.Del("Set-Cookie")
+	i.Response = &recordedResponse{Status: resp.StatusCode, Header: header, Body: string(respBody)}
+	h.add(i)
+
+	return resp, nil
+}
+
+// replayHTTP answers a request with the first unused recorded exchange of the same request
+func (h *fixtureHarness) replayHTTP(req *http.Request, r *recordedRequest) (*http.Response, error) {
+	h.mu.Lock()
+	var mismatch *interaction
+	for idx := range h.fixture.Interactions {
+		i := &h.fixture.Interactions[idx]
+		if i.used || i.Kind != interactionHTTP || i.Request.Method != r.Method || i.Request.URL != r.URL {
+			continue
+		}
+		if i.Request.Body != r.Body {
+			if mismatch == nil {
+				mismatch = i
+			}
+			continue
+		}
+
+		i.used = true
+		h.mu.Unlock()
+
+		if i.Error != "" {
+			return nil, errors.New(i.Error)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", i.Response.Status, http.StatusText(i.Response.Status)),
+			StatusCode:    i.Response.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        i.Response.Header.Clone(),
+			Body:          io.NopCloser(strings.NewReader(i.Response.Body)),
+			ContentLength: int64(len(i.Response.Body)),
+			Request:       req,
+		}, nil
+	}
+	h.mu.Unlock()
+
+	if mismatch != nil {
+		return nil, h.problem("request body of %s %s differs from the fixture %s", r.Method, r.URL, firstDifference(mismatch.Request.Body, r.Body))
+	}
+	return nil, h.problem("no recorded response for %s %s", r.Method, r.URL)
+}
+
+// local records the result of a local tool like OCR or replays it by the kind and the file name,
+// run fills in the output of the tool. Tools that write a new file get an empty one in a replay,
+// all later tools are replayed too.
+func (h *fixtureHarness) local(kind string, file string, output string, run func(i *interaction) error) (interaction, error) {
+	name := filepath.Base(file)
+
+	if !h.replay {
+		i := interaction{Kind: kind, File: name}
+		err := run(&i)
+		if err != nil {
+			i.Error = err.Error()
+		}
+		h.add(i)
+		return i, err
+	}
+
+	h.mu.Lock()
+	for idx := range h.fixture.Interactions {
+		i := &h.fixture.Interactions[idx]
+		if i.used || i.Kind != kind || i.File != name {
+			continue
+		}
+
+		i.used = true
+		h.mu.Unlock()
+
+		if i.Error != "" {
+			return *i, errors.New(i.Error)
+		}
+		if output != "" {
+			return *i, os.WriteFile(output, nil, 0644)
+		}
+		return *i, nil
+	}
+	h.mu.Unlock()
+
+	return interaction{}, h.problem("no recorded %s of %s", kind, name)
+}
+
+// runLocal runs a local tool through the active harness, if there is one. output is the file the
+// tool writes, if any.
+func runLocal(kind string, file string, output string, run func(i *interaction) error) (interaction, error) {
+	if harness != nil {
+		return harness.local(kind, file, output, run)
+	}
+
+	i := interaction{Kind: kind, File: filepath.Base(file)}
+	err := run(&i)
+	return i, err
+}
+
+// inputType returns the type of the recorded input, replays can't sniff the file
+func (h *fixtureHarness) inputType(file string) (fileType, error) {
+	if in := h.fixture.Input; in != nil && in.Name == filepath.Base(file) {
+		return in.Type, nil
+	}
+	return "", h.problem("no recorded type of %s", filepath.Base(file))
+}
+
+func loadFixture(path string) (fixture, error) {
+	var f fixture
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return f, fmt.Errorf("unable to parse fixture %s: %w", path, err)
+	}
+
+	return f, nil
+}
+
+func (h *fixtureHarness) save(path string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	b, err := json.MarshalIndent(h.fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0644)
+}
+
+// replayFixture classifies the fixture's input against its recorded interactions and returns what differs from the recording
+func replayFixture(ctx context.Context, path string) ([]string, error) {
+	f, err := loadFixture(path)
+	if err != nil {
+		return nil, err
+	}
+	if f.Input == nil {
+		return nil, fmt.Errorf("fixture %s was not recorded by classifying a file", path)
+	}
+
+	// the stages expect a file, all tools reading it are replayed
+	dir, err := os.MkdirTemp("", "ai-scan-classifier-replay")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, f.Input.Name)
+	err = os.WriteFile(file, nil, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	h := startHarness(f, true)
+	defer h.stop()
+
+	classification, err := classifyInput(ctx, *f.Input, file)
+
+	problems := h.problems
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("classification failed: %s", err))
+	} else if f.Classification != nil && !reflect.DeepEqual(classification, *f.Classification) {
+		expected, _ := json.Marshal(f.Classification)
+		actual, _ := json.Marshal(classification)
+		problems = append(problems, fmt.Sprintf("classification differs, recorded %s, got %s", expected, actual))
+	}
+
+	for _, i := range h.unused() {
+		if i.Kind != interactionHTTP {
+			problems = append(problems, fmt.Sprintf("recorded %s of %s was not replayed", i.Kind, i.File))
+		} else {
+			problems = append(problems, fmt.Sprintf("recorded request %s %s was not replayed", i.Request.Method, i.Request.URL))
+		}
+	}
+
+	return problems, nil
+}
+
+var replayCommand = &cli.Command{
+	Name:      "replay",
+	Usage:     "Classify recorded files against their fixtures and report regressions",
+	ArgsUsage: "<fixture>...",
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() == 0 {
+			return errors.New("no fixture provided, record one with --record")
+		}
+
+		// the config is not loaded, replays must not depend on the local setup
+		failed := 0
+		for _, path := range c.Args().Slice() {
+			problems, err := replayFixture(c.Context, path)
+			if err != nil {
+				return err
+			}
+
+			if len(problems) == 0 {
+				fmt.Printf("ok    %s\n", path)
+				continue
+			}
+
+			failed++
+			fmt.Printf("FAIL  %s\n", path)
+			for _, p := range problems {
+				fmt.Printf("      %s\n", p)
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d fixtures failed", failed, c.Args().Len())
+		}
+
+		slog.Debug("All fixtures replayed", "fixtures", c.Args().Len())
+		return nil
+	},
+}
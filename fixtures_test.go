@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// withoutTools hides ocrmypdf, pdftotext, img2pdf and gs, replays must not run them
+func withoutTools(t *testing.T) {
+	t.Helper()
+	t.Setenv("PATH", t.TempDir())
+}
+
+func TestReplayFixtures(t *testing.T) {
+	withoutTools(t)
+
+	paths, err := filepath.Glob("testdata/fixtures/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no fixtures in testdata/fixtures")
+	}
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			problems, err := replayFixture(context.Background(), path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range problems {
+				t.Error(p)
+			}
+		})
+	}
+}
+
+// changedFixture writes a copy of a fixture after changing it
+func changedFixture(t *testing.T, path string, change func(f *fixture)) string {
+	t.Helper()
+
+	f, err := loadFixture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(&f)
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := filepath.Join(t.TempDir(), filepath.Base(path))
+	err = os.WriteFile(changed, b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changed
+}
+
+func TestReplayReportsRegressions(t *testing.T) {
+	withoutTools(t)
+
+	tests := []struct {
+		name    string
+		change  func(f *fixture)
+		problem string
+	}{
+		{
+			name: "ocr",
+			change: func(f *fixture) {
+				for i := range f.Interactions {
+					if f.Interactions[i].Kind == interactionOCR {
+						f.Interactions[i].Text = strings.Replace(f.Interactions[i].Text, "Techniker", "Barmer", 1)
+					}
+				}
+			},
+			problem: "request body of POST https://api.openai.com/v1/chat/completions differs from the fixture",
+		},
+		{
+			name: "classification",
+			change: func(f *fixture) {
+				f.Classification.Category = "gov"
+			},
+			problem: "classification differs",
+		},
+		{
+			name: "unused",
+			change: func(f *fixture) {
+				f.Interactions = append(f.Interactions, interaction{Kind: interactionCoverage, File: "letter.pdf"})
+			},
+			problem: "recorded ink_coverage of letter.pdf was not replayed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := changedFixture(t, "testdata/fixtures/letter.json", test.change)
+
+			problems, err := replayFixture(context.Background(), path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.ContainsFunc(problems, func(p string) bool { return strings.Contains(p, test.problem) }) {
+				t.Errorf("problems = %q, want %q", problems, test.problem)
+			}
+		})
+	}
+}
+
+func TestReplayLocalTools(t *testing.T) {
+	h := startHarness(fixture{}, false)
+	_, err := runLocal(interactionOCR, "/spool/1.pdf", "", func(i *interaction) error {
+		i.Text = "text"
+		i.Pages = []int{2}
+		return nil
+	})
+	h.stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h = startHarness(h.fixture, true)
+	defer h.stop()
+
+	i, err := runLocal(interactionOCR, "/tmp/replay/1.pdf", "", func(i *interaction) error {
+		t.Error("OCR was run in a replay")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Text != "text" || !slices.Equal(i.Pages, []int{2}) {
+		t.Errorf("replayed %+v", i)
+	}
+
+	// tools that write files leave an empty one, so the stages find the file they expect
+	output := filepath.Join(t.TempDir(), "1.pdf.cleaned")
+	_, err = runLocal(interactionPages, "/tmp/replay/1.pdf", output, nil)
+	if err == nil || len(h.problems) != 1 {
+		t.Fatalf("unrecorded tool was replayed: %v", err)
+	}
+	h.fixture.Interactions = append(h.fixture.Interactions, interaction{Kind: interactionPages, File: "1.pdf"})
+	_, err = runLocal(interactionPages, "/tmp/replay/1.pdf", output, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Errorf("no output file: %v", err)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/storage"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"github.com/urfave/cli/v2"
+)
+
+// The k-NN mode embeds the OCR text and lets the most similar documents of the user's history vote
+// on the category. The chat model is only asked if the neighbours disagree. Configured with:
+//
+//	knn:
+//	  enabled: true
+//	  k: 5
+//	  agreement: 0.8
+//	  min_neighbours: 3
+//	embeddings:
+//	  model: text-embedding-3-small
+//	  base_url: http://localhost:11434/v1 # any OpenAI compatible endpoint
+//	  api_key: ...
+
+func knnEnabled() bool {
+	return viper.GetBool("knn.enabled")
+}
+
+func embeddingModel() string {
+	viper.SetDefault("embeddings.model", "text-embedding-3-small")
+	return viper.GetString("embeddings.model")
+}
+
+type embeddingRequest struct {
+	Model string `json:"model"`
+	Input string `json:"input"`
+}
+
+type embeddingResponse struct {
+	Data []struct {
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage openai.Usage `json:"usage"`
+}
+
+// embedText returns the embedding of a text. The endpoint is called directly because the
+// OpenAI client only knows a fixed set of embedding models.
+func embedText(ctx context.Context, text string) ([]float32, openai.Usage, error) {
+	viper.SetDefault("embeddings.base_url", "https://api.openai.com/v1")
+	viper.SetDefault("embeddings.max_chars", 8000)
+
+	// stay well below the token limit of the embedding models
+	if maxChars := viper.GetInt("embeddings.max_chars"); len(text) > maxChars {
+		text = strings.ToValidUTF8(text[:maxChars], "")
+	}
+
+	body, err := json.Marshal(embeddingRequest{Model: embeddingModel(), Input: text})
+	if err != nil {
+		return nil, openai.Usage{}, err
+	}
+
+	url := strings.TrimSuffix(viper.GetString("embeddings.base_url"), "/") + "/embeddings"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, openai.Usage{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	apiKey := viper.GetString("embeddings.api_key")
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENAI_KEY")
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := rateLimitedClient("openai").Do(req)
+	if err != nil {
+		return nil, openai.Usage{}, fmt.Errorf("unable to create embedding: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, openai.Usage{}, fmt.Errorf("unable to create embedding: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var r embeddingResponse
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, openai.Usage{}, fmt.Errorf("unable to decode embedding: %w", err)
+	}
+	if len(r.Data) == 0 || len(r.Data[0].Embedding) == 0 {
+		return nil, r.Usage, fmt.Errorf("no embedding returned")
+	}
+
+	return r.Data[0].Embedding, r.Usage, nil
+}
+
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+
+	return dot / math.Sqrt(na*nb)
+}
+
+// knnVote is the outcome of the vote of the nearest neighbours
+type knnVote struct {
+	Category   string
+	Votes      int
+	Neighbours int
+	// Nearest is the most similar neighbour of the winning category
+	Nearest storage.Neighbour
+}
+
+func (v knnVote) agreement() float64 {
+	if v.Neighbours == 0 {
+		return 0
+	}
+	return float64(v.Votes) / float64(v.Neighbours)
+}
+
+// trustedNeighbour reports whether a job's category can be used as a label. Categories of the
+// offline classifier, the fallback and earlier votes are only trusted once the user confirmed them.
+func trustedNeighbour(n storage.Neighbour) bool {
+	return n.Confirmed || slices.Contains([]string{"llm", "rules", "user", ""}, n.Source)
+}
+
+// vote lets the k most similar trusted neighbours vote on the category, ties go to the category
+// of the most similar document
+func vote(vector []float32, neighbours []storage.Neighbour, exclude int64) knnVote {
+	viper.SetDefault("knn.k", 5)
+
+	type scored struct {
+		neighbour  storage.Neighbour
+		similarity float64
+	}
+
+	var candidates []scored
+	for _, n := range neighbours {
+		if n.JobID == exclude || !trustedNeighbour(n) {
+			continue
+		}
+		candidates = append(candidates, scored{n, cosine(vector, n.Vector)})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].similarity > candidates[j].similarity
+	})
+	if k := viper.GetInt("knn.k"); len(candidates) > k {
+		candidates = candidates[:k]
+	}
+
+	votes := map[string]int{}
+	var v knnVote
+	nearest := map[string]storage.Neighbour{}
+	for _, c := range candidates {
+		category := c.neighbour.Category
+		votes[category]++
+		if votes[category] == 1 {
+			nearest[category] = c.neighbour
+		}
+		if votes[category] > v.Votes {
+			v.Category = category
+			v.Votes = votes[category]
+		}
+	}
+	v.Nearest = nearest[v.Category]
+	v.Neighbours = len(candidates)
+
+	return v
+}
+
+// embedJob embeds the job's text and stores the embedding. It is stored before the job is
+// classified, the vote reads the category from the job so the history grows with every document.
+func embedJob(env classifyEnv, pc *PipelineContext) ([]float32, bool) {
+	model := embeddingModel()
+
+	vector, usage, err := embedText(pc.Context, pc.Job.OCR)
+	if usage.TotalTokens > 0 {
+		env.recordUsage(pc.Job, model, usage)
+	}
+	if err != nil {
+		pc.Logger.Warn("Error embedding text", "error", err)
+		return nil, false
+	}
+	if !env.cache {
+		return vector, true
+	}
+
+	err = storage.SaveEmbedding(env.db, pc.Job.ID, pc.Job.User, model, vector)
+	if err != nil {
+		pc.Logger.Warn("Error saving embedding", "error", err)
+	}
+
+	return vector, true
+}
+
+// classifyKNN embeds the job's text and classifies the job if enough neighbours agree on a category.
+// Documents with the same content don't vote, like few-shot examples.
+func classifyKNN(env classifyEnv, pc *PipelineContext) (storage.Classification, bool) {
+	vector, ok := embedJob(env, pc)
+	if !ok {
+		return storage.Classification{}, false
+	}
+
+	neighbours, err := storage.UserNeighbours(env.db, pc.Job.User, embeddingModel())
+	if err != nil {
+		pc.Logger.Warn("Error loading neighbours", "error", err)
+		return storage.Classification{}, false
+	}
+	if pc.Job.Hash != "" {
+		neighbours = slices.DeleteFunc(neighbours, func(n storage.Neighbour) bool {
+			return n.Hash == pc.Job.Hash
+		})
+	}
+
+	v := vote(vector, neighbours, pc.Job.ID)
+	if !v.decisive() {
+		pc.Logger.Debug("No k-NN majority, asking the LLM", "category", v.Category, "votes", v.Votes, "neighbours", v.Neighbours)
+		return storage.Classification{}, false
+	}
+
+	return v.classification(pc.Job.File, pc.Job.OCR), true
+}
+
+// decisive reports whether enough neighbours agree to classify without the LLM
+func (v knnVote) decisive() bool {
+	viper.SetDefault("knn.agreement", 0.8)
+	viper.SetDefault("knn.min_neighbours", 3)
+
+	return v.Neighbours >= viper.GetInt("knn.min_neighbours") && v.agreement() >= viper.GetFloat64("knn.agreement")
+}
+
+// classification turns the vote into a classification. The vote only yields a category, title and
+// sender are borrowed from the most similar document of that category and the date is read from the text.
+func (v knnVote) classification(file string, ocr string) storage.Classification {
+	classification := fallbackClassification(file)
+	classification.Category = v.Category
+	classification.Title = cmp.Or(v.Nearest.Title, classification.Title)
+	classification.Sender = v.Nearest.Sender
+	classification.Date = textDate(ocr)
+	classification.Explanation = fmt.Sprintf("Classified as %s because %d of the %d most similar documents are, the title is taken from job %d",
+		v.Category, v.Votes, v.Neighbours, v.Nearest.JobID)
+
+	return classification
+}
+
+// dateFormats are the date formats found in letters, by the layout time.Parse needs for them
+var dateFormats = map[string]*regexp.Regexp{
+	"2006-01-02": regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`),
+	"2.1.2006":   regexp.MustCompile(`\b\d{1,2}\.\d{1,2}\.\d{4}\b`),
+}
+
+// textDate returns the first valid date in a text as YYYY-MM-DD, letters put their date near the top
+func textDate(text string) string {
+	first := -1
+	var date string
+	for layout, re := range dateFormats {
+		for _, m := range re.FindAllStringIndex(text, -1) {
+			if first != -1 && m[0] > first {
+				break
+			}
+			t, err := time.Parse(layout, text[m[0]:m[1]])
+			if err != nil {
+				continue
+			}
+			first, date = m[0], t.Format("2006-01-02")
+			break
+		}
+	}
+	return date
+}
+
+var knnCommand = &cli.Command{
+	Name:  "knn",
+	Usage: "Manage the embeddings of the k-NN mode",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "backfill",
+			Usage: "Embed finished jobs that have no embedding yet",
+			Action: func(c *cli.Context) error {
+				err := loadConfig()
+				if err != nil {
+					return err
+				}
+
+				db, err := storage.OpenDB(viperDatabase())
+				if err != nil {
+					slog.Error("Error opening database", "error", err)
+					return err
+				}
+				defer db.Close()
+
+				model := embeddingModel()
+				jobs, err := storage.JobsWithoutEmbedding(db, model)
+				if err != nil {
+					return err
+				}
+
+				for i := range jobs {
+					job := &jobs[i]
+
+					vector, usage, err := embedText(c.Context, job.OCR)
+					if usage.TotalTokens > 0 {
+						recordUsage(db, job, model, usage)
+					}
+					if err != nil {
+						return err
+					}
+
+					err = storage.SaveEmbedding(db, job.ID, job.User, model, vector)
+					if err != nil {
+						return err
+					}
+				}
+
+				slog.Info("Embedded jobs", "jobs", len(jobs), "model", model)
+				return nil
+			},
+		},
+	},
+}
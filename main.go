@@ -3,22 +3,24 @@ package main
 import (
 	"3nt3/ai-scan-classifier/storage"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"bytes"
-
 	"github.com/jlaffaye/ftp"
 	"github.com/lmittmann/tint"
-	"github.com/mymmrac/telego"
-	tu "github.com/mymmrac/telego/telegoutil"
 	"github.com/spf13/viper"
 	"github.com/urfave/cli/v2"
 
@@ -29,6 +31,10 @@ import (
 func main() {
 	var programLevel = new(slog.LevelVar) // Info by default
 
+	// SIGINT and SIGTERM cancel the context, the daemon then finishes running jobs and exits
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	app := &cli.App{
 		Name:    "ai-scan-classifier",
 		Usage:   "Classify the content of a scanned document using OpenAI's ChatGPT",
@@ -59,8 +65,19 @@ func main() {
 				Usage:   "Run the app as a daemon",
 				Aliases: []string{"d"},
 			},
+			&cli.StringFlag{
+				Name:  "record",
+				Usage: "Record all OCR runs, text layers and HTTP exchanges into a fixture file, see the replay command",
+			},
 		},
 		Commands: []*cli.Command{
+			cacheCommand,
+			usageCommand,
+			classifierCommand,
+			knnCommand,
+			evalCommand,
+			replayCommand,
+			experimentCommand,
 			{
 				Name:    "classify",
 				Aliases: []string{"c"},
@@ -109,13 +126,24 @@ func main() {
 				return nil
 			}
 
+			if c.IsSet("record") {
+				h := startHarness(fixture{}, false)
+				defer func() {
+					h.stop()
+					err := h.save(c.String("record"))
+					if err != nil {
+						slog.Error("Error saving fixture", "error", err)
+						return
+					}
+					slog.Info("Saved fixture", "path", c.String("record"), "interactions", len(h.fixture.Interactions))
+				}()
+			}
+
 			// check for daemon flag
 			if c.Bool("daemon") {
 				slog.Info("Running as daemon")
 
-				go storage.RunServer()
-
-				return daemon()
+				return daemon(c.Context)
 			}
 
 			// if no arguments are provided and it's not the help command, return an errors
@@ -123,118 +151,226 @@ func main() {
 				return errors.New("No file provided")
 			}
 
-			classifyFile(c.Args().First())
+			file := c.Args().First()
+			classification, err := classifyFile(c.Context, file)
+			if err != nil {
+				return err
+			}
+
+			if harness != nil {
+				harness.fixture.Classification = &classification
+			}
 			return nil
 		},
 		EnableBashCompletion: true,
 	}
 
-	app.Run(os.Args)
+	app.RunContext(ctx, os.Args)
 }
 
-func classifyFile(file string) (storage.Classification, error) {
-	// remove files from previous runs
-	toRemove := []string{"/tmp/output.pdf", "/tmp/output.pdf.txt"}
-	for _, file := range toRemove {
-		err := os.Remove(file)
+// classifyFile classifies a file given on the command line
+func classifyFile(ctx context.Context, file string) (storage.Classification, error) {
+	t, err := sniffFile(file)
+	if err != nil {
+		return storage.Classification{}, err
+	}
+
+	hash, err := fileHash(file)
+	if err != nil {
+		return storage.Classification{}, err
+	}
+
+	input := fixtureInput{Name: filepath.Base(file), Hash: hash, Type: t}
+	if harness != nil {
+		harness.fixture.Input = &input
+	}
+
+	// the stages change the file, the one given on the command line is left as it is
+	dir, err := os.MkdirTemp("", "ai-scan-classifier-classify")
+	if err != nil {
+		return storage.Classification{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	localFile := filepath.Join(dir, input.Name)
+	err = copyFile(file, localFile)
+	if err != nil {
+		return storage.Classification{}, err
+	}
+
+	return classifyInput(ctx, input, localFile)
+}
+
+// classifyStages are the stages of the daemon that classify a file, the others need the FTP
+// server, add jobs or file the document
+var classifyStages = []string{"convert", "cleanup", "ocr", "dedupe", "rules", "classify"}
+
+// classifyInput runs a file through the classify stages against a database in memory, like a job
+// of nobody in the daemon
+func classifyInput(ctx context.Context, input fixtureInput, localFile string) (storage.Classification, error) {
+	db, err := storage.OpenDB(":memory:")
+	if err != nil {
+		return storage.Classification{}, err
+	}
+	defer db.Close()
+
+	_, err = storage.EnqueueJob(db, "", input.Name, 0, time.Time{}, classifyStages[0])
+	if err != nil {
+		return storage.Classification{}, err
+	}
+	job, err := storage.ClaimJob(db, classifyStages[:1])
+	if err != nil {
+		return storage.Classification{}, err
+	}
+	job.LocalFile = localFile
+	// images are hashed before they are converted, like the file given on the command line
+	job.Artifacts = map[string]string{"sha256": input.Hash}
+
+	stages := pipelineStages(db)
+	pipeline := &Pipeline{}
+	for _, name := range classifyStages {
+		stage, ok := findStage(stages, name)
+		if !ok {
+			return storage.Classification{}, fmt.Errorf("unknown stage %s", name)
+		}
+		pipeline.stages = append(pipeline.stages, stage)
+	}
+
+	for _, stage := range pipeline.stages {
+		err := pipeline.Run(ctx, stage, job)
 		if err != nil {
-			slog.Warn(fmt.Sprintf("Error removing file: %s", file), "error", err)
+			return storage.Classification{}, err
 		}
 	}
 
+	spent, err := storage.MonthlyCost(db, "", time.Now())
+	if err != nil {
+		return storage.Classification{}, err
+	}
+
+	slog.Info("Usage", "model", job.Model, "classifier", job.Artifacts["classifier"], "cost", spent)
+	return job.Classification, nil
+}
+
+// ocrFile runs ocrmypdf on a file and returns the recognized text. If the options change the pages,
+// the file is replaced by the corrected PDF and the pages that were turned are returned.
+func ocrFile(ctx context.Context, file string, opts ocrOptions) (string, []int, error) {
+	i, err := runLocal(interactionOCR, file, "", func(i *interaction) error {
+		var err error
+		i.Text, i.Pages, err = runOCR(ctx, file, opts)
+		return err
+	})
+	return i.Text, i.Pages, err
+}
+
+func runOCR(ctx context.Context, file string, opts ocrOptions) (string, []int, error) {
+	// every run gets its own directory so that multiple OCR workers don't overwrite each other
+	dir, err := os.MkdirTemp("", "ai-scan-classifier-ocr")
+	if err != nil {
+		slog.Error("Error creating temporary directory", "error", err)
+		return "", nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	outputFile := filepath.Join(dir, "output.pdf")
+	sidecarFile := filepath.Join(dir, "output.pdf.txt")
+
 	slog.Info("Processing file", "file", file)
 
-	output, err := exec.Command("ocrmypdf", file, "--redo-ocr", "-l", "deu", "/tmp/output.pdf", "--sidecar").CombinedOutput()
+	args := append([]string{file}, opts.args()...)
+	args = append(args, "-l", "deu", outputFile, "--sidecar", sidecarFile)
+	output, err := exec.CommandContext(ctx, "ocrmypdf", args...).CombinedOutput()
 	if err != nil {
 		slog.Error("Error running ocrmypdf", "error", err, "output", string(output))
-		return storage.Classification{}, err
+		return "", nil, err
 	}
 
 	// read the sidecar file
-	ocr, err := os.ReadFile("/tmp/output.pdf.txt")
+	ocr, err := os.ReadFile(sidecarFile)
 	if err != nil {
 		slog.Error("Error reading sidecar file", "error", err)
-		return storage.Classification{}, err
+		return "", nil, err
+	}
+
+	if !opts.changesPages() {
+		return string(ocr), nil, nil
+	}
+
+	err = copyFile(outputFile, file)
+	if err != nil {
+		slog.Error("Error replacing file with corrected pages", "error", err)
+		return "", nil, err
+	}
+
+	return string(ocr), rotatedPages(string(output)), nil
+}
+
+// classificationModel is the OpenAI model used for classification
+const classificationModel = openai.GPT4
+
+// classifyText asks the LLM to classify the OCR text of a document and returns the token usage of the call.
+// Hints and examples of the prompt context are added to the prompt.
+func classifyText(ctx context.Context, model string, ocr string, pctx promptContext) (storage.Classification, openai.Usage, error) {
+	p := pctx.Prompt
+	if p.Text == "" {
+		var err error
+		p, err = loadPrompt("", "")
+		if err != nil {
+			return storage.Classification{}, openai.Usage{}, err
+		}
 	}
 
 	// only include the first 2000 characters
 	ocr = ocr[:min(2000, len(ocr))]
 
-	// chop up ocr into chunks of 2000 characters and convert to ChatCompletionMessage:
-	var messages []openai.ChatCompletionMessage
-	for i := 0; i < len(ocr); i += 2000 {
+	// all LLM workers share the OpenAI rate limit
+	config := openai.DefaultConfig(os.Getenv("OPENAI_KEY"))
+	config.HTTPClient = rateLimitedClient("openai")
+
+	messages := []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleUser,
+			Content: p.Text,
+		},
+	}
+	for _, message := range pctx.messages() {
 		messages = append(messages, openai.ChatCompletionMessage{
 			Role:    openai.ChatMessageRoleUser,
-			Content: string(ocr[i:min(i+2000, len(ocr))]),
+			Content: message,
 		})
 	}
+	messages = append(messages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: string(ocr),
+	})
 
-	openaiKey := os.Getenv("OPENAI_KEY")
-
-	prompt := `
-	You will be provided with a the OCR version of a scanned document, and your
-	task is to classify its content as one of the following categories. Give an explanation, a title, a filename, and a category in JSON format.
-
-    An example response would be:
-    {"category": "tk", "explanation": "This is a scan of a letter by TK (Techniker Krankenkasse), issuing an SMS-Tan reset code", title: "SMS-TAN Wiederherstellungscode", "filename": "sms_tan_reset_code.pdf"}
-
-	- bizfactory: A document that is related to my work at Biz Factory GmbH
-	- ids: A scan of an ID card, passport, or similar card
-	- klausuren: A scan of an exam or similar
-	- schule: A document that is related to my school education
-	- sparkasse: A document that is related to my bank account at Sparkasse
-    - deka: A document that is related to my investment at Deka
-    - db: A document that is related to Deutsche Bahn
-    - taxes: A document that is related to taxes
-	- comdirect: A document that is related to my bank account at Comdirect
-	- th-koeln: A document that is related to my studies at Technische Hochschule Köln
-	- tk: A document that is related to my health insurance at TK (Techniker Krankenkasse)
-    - gov: A document that is issued by a government or other official institution
-    - hildebrandtstraße: A document that is related to the apartment at Hildebrandtstraße 8
-    - check24: A document that is related to my work at Check24
-    - insurance: A document that is related to insurance
-	- misc: A document that does not fit into any of the above categories
-    - rheinbahn: A document that is related to Rheinbahn
-    - hs-bochum: A document that is related to my studies at Hochschule Bochum
-
-    If you feel that the document does not fit any of the above categories but fits well in a broader category, you may suggest one (only in one word). Only do so as a last resort.
-	`
-
-	client := openai.NewClient(openaiKey)
+	client := openai.NewClientWithConfig(config)
 	resp, err := client.CreateChatCompletion(
-		context.Background(),
+		ctx,
 		openai.ChatCompletionRequest{
-			Model: openai.GPT4,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: prompt,
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: string(ocr),
-				},
-			},
+			Model:    model,
+			Messages: messages,
 		},
 	)
 
 	if err != nil {
 		slog.Error("Error running OpenAI API", "error", err)
-		return storage.Classification{}, err
+		return storage.Classification{}, openai.Usage{}, err
 	}
 
 	var classification storage.Classification
 	err = json.Unmarshal([]byte(resp.Choices[0].Message.Content), &classification)
 	if err != nil {
 		slog.Error("Error parsing OpenAI response", "error", err)
-		return storage.Classification{}, err
+		return storage.Classification{}, resp.Usage, err
 	}
 
 	slog.Info("Classification", "title", classification.Title, "category", classification.Category, "explanation", classification.Explanation)
-	return classification, nil
+	return classification, resp.Usage, nil
 }
 
-func daemon() error {
+// loadConfig reads daemon.yml from the working directory
+func loadConfig() error {
 	viper.SetConfigName("daemon")
 	viper.SetConfigType("yml")
 	viper.AddConfigPath(".")
@@ -245,6 +381,69 @@ func daemon() error {
 		return err
 	}
 
+	return nil
+}
+
+// viperDatabase returns the path of the sqlite database
+func viperDatabase() string {
+	viper.SetDefault("database", "./tokens.db")
+	return viper.GetString("database")
+}
+
+// daemon watches the FTP server and processes new scans until ctx is cancelled
+func daemon(ctx context.Context) error {
+	err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	err = validateRules()
+	if err != nil {
+		slog.Error("Invalid rules", "error", err)
+		return err
+	}
+
+	err = validatePrompts()
+	if err != nil {
+		slog.Error("Invalid prompts", "error", err)
+		return err
+	}
+
+	err = validateCollisionStrategies()
+	if err != nil {
+		slog.Error("Invalid collision strategy", "error", err)
+		return err
+	}
+
+	db, err := storage.OpenDB(viperDatabase())
+	if err != nil {
+		slog.Error("Error opening database", "error", err)
+		return err
+	}
+	defer db.Close()
+
+	viper.SetDefault("shutdown_timeout", 30*time.Second)
+
+	serverCtx, stopServer := context.WithCancel(ctx)
+	var servers sync.WaitGroup
+	servers.Add(2)
+	go func() {
+		defer servers.Done()
+		err := storage.RunServer(serverCtx, db, viper.GetString("api_token"))
+		if err != nil {
+			slog.Error("Error running HTTP server", "error", err)
+		}
+	}()
+	// answers to questions like what to do with a duplicate
+	go func() {
+		defer servers.Done()
+		listenTelegram(serverCtx, db)
+	}()
+	defer func() {
+		stopServer()
+		servers.Wait()
+	}()
+
 	if !viper.IsSet("ftp.host") {
 		slog.Error("FTP host not set")
 		return errors.New("FTP host not set")
@@ -284,46 +483,78 @@ func daemon() error {
 		return err
 	}
 
-	// Store already known files and their size
-	knownFiles := make(map[string]map[string]bool)
-	firstRun := true
+	// the FTP connection is shared between the poller and the download workers
+	var ftpMutex sync.Mutex
 
-	_, err = c.List(path)
+	viper.SetDefault("spool_dir", "./spool")
+	spoolDir := viper.GetString("spool_dir")
+
+	err = os.MkdirAll(spoolDir, 0o755)
 	if err != nil {
-		slog.Error("Error listing FTP directory", "error", err)
+		slog.Error("Error creating spool directory", "error", err)
 		return err
 	}
 
-	slog.Info("Known files", "files", knownFiles)
+	pipeline, err := newPipeline(append([]Stage{
+		funcStage{"download", "download", func(pc *PipelineContext) error {
+			ftpMutex.Lock()
+			defer ftpMutex.Unlock()
+
+			fileName, err := downloadFile(c, fmt.Sprintf("%s/%s/%s", path, pc.Job.User, pc.Job.File), filepath.Join(spoolDir, fmt.Sprintf("%d.pdf", pc.Job.ID)))
+			if err != nil {
+				return err
+			}
+
+			pc.Job.LocalFile = fileName
+			return nil
+		}},
+	}, pipelineStages(db)...))
+	if err != nil {
+		slog.Error("Error building pipeline", "error", err)
+		return err
+	}
+	// recover is innermost so that panics show up in logs and metrics as failures
+	pipeline.Use(loggingMiddleware, metricsMiddleware, recoverMiddleware)
+
+	q := newQueue(db, pipeline)
+
+	err = q.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer q.shutdown(viper.GetDuration("shutdown_timeout"))
+	defer newFiles.flushAll()
 
 	for {
+		ftpMutex.Lock()
 		entries, err := c.List(path)
+		ftpMutex.Unlock()
 		if err != nil {
 			slog.Error("Error listing FTP directory", "error", err)
 			return err
 		}
 
-		slog.Debug("Known files", "files", knownFiles)
-
+		// user folders are scanned one after another, so a folder is never processed twice at the same time
 		for _, entry := range entries {
 			if entry.Type != ftp.EntryTypeFolder {
 				slog.Warn("Your FTP directory should only contain folders, check your printer configuration", "file", entry.Name)
 				continue
 			}
 
-			go processUserFolder(c, path, entry.Name, knownFiles[entry.Name])
+			processUserFolder(db, c, &ftpMutex, path, entry.Name, pipeline.First())
 		}
 
-		time.Sleep(5 * time.Second)
-
-		if firstRun {
-			firstRun = false
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopped watching FTP")
+			return nil
+		case <-time.After(5 * time.Second):
 		}
 	}
 }
 
-func downloadFile(c *ftp.ServerConn, path string) (string, error) {
-	file, err := os.CreateTemp("", "ai-scan-classifier")
+func downloadFile(c *ftp.ServerConn, path string, destination string) (string, error) {
+	file, err := os.Create(destination)
 	if err != nil {
 		slog.Error("Error creating file", "error", err)
 		return "", err
@@ -352,214 +583,624 @@ func downloadFile(c *ftp.ServerConn, path string) (string, error) {
 	return file.Name(), nil
 }
 
-func sendTelegramMessage(user string, message string) error {
-	if !viper.IsSet("telegram_token") {
-		return errors.New("Telegram token not set")
+func uploadFileToNextcloud(ctx context.Context, user string, path storage.PathTemplate, classification storage.Classification, localFilePath string) (storage.StoredFile, error) {
+	// Read the file contents into a byte slice
+	fileContents, err := os.ReadFile(localFilePath)
+	if err != nil {
+		slog.Error("Error reading local file", "error", err)
+		return storage.StoredFile{}, err
 	}
 
-	token := viper.GetString("telegram_token")
+	// Get the Nextcloud credentials from the environment
+	nextcloudURL := viper.GetString(fmt.Sprintf("%s.nextcloud.url", user))
+	username := viper.GetString(fmt.Sprintf("%s.nextcloud.username", user))
+	password := viper.GetString(fmt.Sprintf("%s.nextcloud.password", user))
+
+	if !viper.IsSet(fmt.Sprintf("%s.nextcloud.url", user)) {
+		slog.Error("Nextcloud URL not set", "user", user)
+		return storage.StoredFile{}, errors.New("Nextcloud URL not set")
+	}
 
-	// get username from config
-	if !viper.IsSet(fmt.Sprintf("users.%s.telegram", user)) {
-		return errors.New("Telegram user not set")
+	if !viper.IsSet(fmt.Sprintf("%s.nextcloud.username", user)) {
+		slog.Error("Nextcloud username not set", "user", user)
+		return storage.StoredFile{}, errors.New("Nextcloud username not set")
 	}
 
-	telegramUser := viper.GetString(fmt.Sprintf("users.%s.telegram", user))
+	if !viper.IsSet(fmt.Sprintf("%s.nextcloud.password", user)) {
+		slog.Error("Nextcloud password not set", "user", user)
+		return storage.StoredFile{}, errors.New("Nextcloud password not set")
+	}
 
-	bot, err := telego.NewBot(token, telego.WithDefaultDebugLogger())
-	if err != nil {
-		slog.Error("Error creating Telegram bot", "error", err)
-		return err
+	// Nextcloud is a WebDAV server with a per-user files collection and links by file id
+	nextcloud := &storage.Nextcloud{
+		WebDAV: storage.WebDAV{
+			URL:          nextcloudURL,
+			BasePath:     fmt.Sprintf("/remote.php/dav/files/%s", username),
+			Username:     username,
+			Password:     password,
+			Path:         path,
+			LinkTemplate: `{{.BaseURL}}/f/{{.FileID}}`,
+			Collision:    collisionStrategy(user),
+		},
+		Tags:        viper.GetBool(fmt.Sprintf("%s.nextcloud.tags", user)),
+		Comment:     viper.GetBool(fmt.Sprintf("%s.nextcloud.comment", user)),
+		ShareLink:   viper.GetBool(fmt.Sprintf("%s.nextcloud.share_link", user)),
+		ShareExpiry: viper.GetDuration(fmt.Sprintf("%s.nextcloud.share_expiry", user)),
 	}
 
-	msg, err := bot.SendMessage(tu.Message(tu.Username(telegramUser), message).WithParseMode(telego.ModeHTML))
+	stored, err := nextcloud.StoreFile(ctx, fileContents, classification)
 	if err != nil {
-		slog.Error("Error sending Telegram message", "error", err)
-		return err
+		slog.Error("Error uploading file to Nextcloud", "error", err)
+		return storage.StoredFile{}, err
 	}
 
-	slog.Info("Sent Telegram message", "message", msg)
+	slog.Info("Uploaded file to Nextcloud", "url", stored.URL)
 
-	return nil
+	return stored, nil
 }
 
-func uploadFileToNextcloud(user string, classification storage.Classification, localFilePath string) (string, error) {
-	// Open local file
-	file, err := os.Open(localFilePath)
-	if err != nil {
-		slog.Error("Error opening local file", "error", err)
-		return "", err
+func uploadFileToWebDAV(ctx context.Context, user string, path storage.PathTemplate, classification storage.Classification, localFilePath string) (storage.StoredFile, error) {
+	if !viper.IsSet(fmt.Sprintf("users.%s.webdav.url", user)) {
+		slog.Error("WebDAV URL not set", "user", user)
+		return storage.StoredFile{}, errors.New("WebDAV URL not set")
 	}
-	defer file.Close()
 
-	// Read the file contents into a byte slice
-	fileContents, err := io.ReadAll(file)
+	data, err := os.ReadFile(localFilePath)
 	if err != nil {
 		slog.Error("Error reading local file", "error", err)
-		return "", err
+		return storage.StoredFile{}, err
 	}
 
-	// Get the Nextcloud credentials from the environment
-	nextcloudURL := viper.GetString(fmt.Sprintf("%s.nextcloud.url", user))
-	username := viper.GetString(fmt.Sprintf("%s.nextcloud.username", user))
-	password := viper.GetString(fmt.Sprintf("%s.nextcloud.password", user))
-
-	if !viper.IsSet(fmt.Sprintf("%s.nextcloud.url", user)) {
-		slog.Error("Nextcloud URL not set", "user", user)
-		return "", errors.New("Nextcloud URL not set")
+	if viper.IsSet(fmt.Sprintf("users.%s.webdav.path_template", user)) {
+		path.Default = viper.GetString(fmt.Sprintf("users.%s.webdav.path_template", user))
 	}
 
-	if !viper.IsSet(fmt.Sprintf("%s.nextcloud.username", user)) {
-		slog.Error("Nextcloud username not set", "user", user)
-		return "", errors.New("Nextcloud username not set")
+	webdav := &storage.WebDAV{
+		URL:          viper.GetString(fmt.Sprintf("users.%s.webdav.url", user)),
+		BasePath:     viper.GetString(fmt.Sprintf("users.%s.webdav.base_path", user)),
+		Username:     viper.GetString(fmt.Sprintf("users.%s.webdav.username", user)),
+		Password:     viper.GetString(fmt.Sprintf("users.%s.webdav.password", user)),
+		Path:         path,
+		LinkTemplate: viper.GetString(fmt.Sprintf("users.%s.webdav.link_template", user)),
+		Collision:    collisionStrategy(user),
 	}
 
-	if !viper.IsSet(fmt.Sprintf("%s.nextcloud.password", user)) {
-		slog.Error("Nextcloud password not set", "user", user)
-		return "", errors.New("Nextcloud password not set")
+	stored, err := webdav.StoreFile(ctx, data, classification)
+	if err != nil {
+		slog.Error("Error uploading file via WebDAV", "error", err)
+		return storage.StoredFile{}, err
 	}
 
-	now := time.Now()
-	newFileName := fmt.Sprintf("%s_%s", now.Format("2006-01-02"), classification.FileName)
-
-	remotePath := fmt.Sprintf("Documents/scans/%s/%s", classification.Category, newFileName)
-	slog.Debug("Uploading file to Nextcloud", "remotePath", remotePath)
+	return stored, nil
+}
 
-	// Create a PUT request to upload the file to Nextcloud
-	requestURL := fmt.Sprintf("%s/remote.php/dav/files/%s/%s", nextcloudURL, username, remotePath)
-	req, err := http.NewRequest("PUT", requestURL, bytes.NewReader(fileContents))
-	if err != nil {
-		slog.Error("Error creating PUT request", "error", err)
-		return "", err
+func uploadFileToPaperless(ctx context.Context, user string, tags []string, classification storage.Classification, localFilePath string) (storage.StoredFile, error) {
+	if !viper.IsSet(fmt.Sprintf("users.%s.paperless.url", user)) {
+		slog.Error("Paperless URL not set", "user", user)
+		return storage.StoredFile{}, errors.New("Paperless URL not set")
 	}
 
-	// Set the request headers
-	req.Header.Set("Content-Type", "application/octet-stream")
-	req.SetBasicAuth(username, password)
+	if !viper.IsSet(fmt.Sprintf("users.%s.paperless.token", user)) {
+		slog.Error("Paperless token not set", "user", user)
+		return storage.StoredFile{}, errors.New("Paperless token not set")
+	}
 
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	data, err := os.ReadFile(localFilePath)
 	if err != nil {
-		slog.Error("Error sending PUT request", "error", err)
-		return "", err
+		slog.Error("Error reading local file", "error", err)
+		return storage.StoredFile{}, err
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	slog.Debug("Response body", "body", string(body))
 
-	// Check if the request was successful
-	if resp.StatusCode != http.StatusCreated {
-		slog.Error("Error uploading file to Nextcloud", "status", resp.Status)
+	paperless := &storage.Paperless{
+		URL:        viper.GetString(fmt.Sprintf("users.%s.paperless.url", user)),
+		Token:      viper.GetString(fmt.Sprintf("users.%s.paperless.token", user)),
+		CategoryAs: viper.GetString(fmt.Sprintf("users.%s.paperless.category_as", user)),
+		Tags:       tags,
+	}
 
-		return "", errors.New(fmt.Sprintf("Error uploading file to Nextcloud: %s, %v", resp.Status, string(body)))
+	stored, err := paperless.StoreFile(ctx, data, classification)
+	if err != nil {
+		slog.Error("Error storing file in Paperless", "error", err)
+		return storage.StoredFile{}, err
 	}
 
-	slog.Info("Uploaded file to Nextcloud", "remotePath", remotePath)
+	slog.Info("Uploaded file to Paperless", "url", stored.URL)
 
-	// get the oc-fileid from response headers
-	ocFileId := resp.Header.Get("oc-fileid")
-	ocEtag := resp.Header.Get("oc-etag")
+	return stored, nil
+}
 
-	slog.Debug("oc-fileid", "oc-fileid", ocFileId)
-	slog.Debug("oc-etag", "oc-etag", ocEtag)
+// pipelineStages are the built-in stages after the download
+func pipelineStages(db *sql.DB) []Stage {
+	return []Stage{
+		funcStage{"convert", "ocr", convertStage},
+		funcStage{"cleanup", "ocr", func(pc *PipelineContext) error {
+			return cleanupStage(db, pc)
+		}},
+		funcStage{"ocr", "ocr", func(pc *PipelineContext) error {
+			return ocrStage(db, pc)
+		}},
+		funcStage{"split", "ocr", func(pc *PipelineContext) error {
+			return splitStage(db, pc)
+		}},
+		funcStage{"dedupe", "default", func(pc *PipelineContext) error {
+			return dedupeStage(db, pc)
+		}},
+		funcStage{"rules", "default", rulesStage},
+		funcStage{"classify", "llm", func(pc *PipelineContext) error {
+			return classifyStage(db, pc)
+		}},
+		funcStage{"route", "default", func(pc *PipelineContext) error {
+			return routeStage(db, pc)
+		}},
+		funcStage{"upload", "upload", func(pc *PipelineContext) error {
+			return uploadStage(db, pc)
+		}},
+		funcStage{"notify", "upload", notifyStage},
+	}
+}
 
-	return fmt.Sprintf("%s/f/%s", nextcloudURL, ocFileId), nil
+// ftpLister lists FTP directories, it is satisfied by *ftp.ServerConn
+type ftpLister interface {
+	List(path string) ([]*ftp.Entry, error)
 }
 
-func processUserFolder(c *ftp.ServerConn, path string, user string, knownFiles map[string]bool) {
+// processUserFolder adds the new files of a user's FTP folder to the queue
+func processUserFolder(db *sql.DB, c ftpLister, ftpMutex *sync.Mutex, path string, user string, firstStage string) {
+	ftpMutex.Lock()
 	entries, err := c.List(fmt.Sprintf("%s/%s", path, user))
+	ftpMutex.Unlock()
 	if err != nil {
 		slog.Error("Error listing FTP directory", "error", err)
 		return
 	}
 
 	for _, entry := range entries {
-		if entry.Type != ftp.EntryTypeFolder {
-			slog.Warn("Your FTP user directories should only contain files, go fuck yourself", "folder", entry.Name)
+		if entry.Type != ftp.EntryTypeFile {
+			slog.Warn("Your FTP user directories should only contain files", "folder", entry.Name)
+			continue
+		}
+
+		added, err := storage.EnqueueJob(db, user, entry.Name, int64(entry.Size), entry.Time, firstStage)
+		if err != nil {
+			slog.Error("Error adding file to queue", "file", entry.Name, "error", err)
+			continue
 		}
 
-		if _, ok := knownFiles[entry.Name]; ok {
+		if !added {
 			continue
 		}
 
-		slog.Info("New file", "file", entry.Name)
-		sendTelegramMessage(user, fmt.Sprintf("<b>New file: <code>%s</code></b>", entry.Name))
+		slog.Info("New file", "user", user, "file", entry.Name)
+		newFiles.add(user, entry.Name)
+	}
+}
 
-		const maxTries = 5
-		const delay = 5 * time.Second
-		for i := 0; i < maxTries; i++ {
-			fileName, err := downloadFile(c, fmt.Sprintf("%s/%s", path, entry.Name))
-			if err != nil {
-				slog.Error("Error downloading file", "error", err)
-				sendTelegramMessage(user, fmt.Sprintf("Error downloading file: <pre>%s</pre>", err))
-				sendTelegramMessage(user, fmt.Sprintf("%d tries left", maxTries-i))
-				time.Sleep(delay)
-				continue
-			}
-			classification, err := classifyFile(fileName)
+func ocrStage(db *sql.DB, pc *PipelineContext) error {
+	// converted images have no text layer
+	var text string
+	var ok bool
+	var err error
+	if pc.Artifact("input_type") == string(typePDF) {
+		text, ok, err = textLayer(pc.Context, pc.Job.LocalFile, pc.Job.User)
+		if err != nil {
+			return err
+		}
+	}
+	if ok {
+		pc.Logger.Info("Using text layer instead of OCR")
+		pc.SetArtifact("text_source", "text_layer")
+		pc.Job.OCR = text
+		return nil
+	}
+	pc.SetArtifact("text_source", "ocr")
+
+	opts := cleanupOptions(pc.Job.User)
+
+	// the cached text belongs to the uncorrected scan, the pages still have to be turned and deskewed
+	var ocr string
+	if !opts.changesPages() {
+		ocr, ok, err = cachedOCR(db, pc)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !ok {
+		var rotated []int
+		ocr, rotated, err = ocrFile(pc.Context, pc.Job.LocalFile, opts)
+		if err != nil {
+			return err
+		}
+
+		report := cleanupReportOf(pc)
+		report.RotatedPages = rotated
+		report.Deskewed = opts.Deskew
+		report.Cleaned = opts.Clean
+		report.save(pc)
+
+		err = storage.CacheOCR(db, pc.Artifact("sha256"), ocr)
+		if err != nil {
+			pc.Logger.Warn("Error caching OCR text", "error", err)
+		}
+	}
+
+	pc.Job.OCR = ocr
+	return nil
+}
+
+func classifyStage(db *sql.DB, pc *PipelineContext) error {
+	// skipped duplicates reuse the classification of the original
+	if pc.Artifact("duplicate_action") == duplicateSkip {
+		return nil
+	}
+
+	return classifyJob(daemonEnv(db), pc)
+}
+
+// classifyEnv is what the classification of a job reads and writes besides the job. The daemon
+// records usage and caches classifications and embeddings, eval --pipeline only reads the history.
+type classifyEnv struct {
+	db *sql.DB
+	// model is the regular model, the budget switches to a cheaper one
+	model string
+	// prompt is the name of the regular prompt, "" is the user's prompt
+	prompt string
+	// cache reads and writes cached classifications and stores embeddings for later documents
+	cache bool
+	// recordUsage is called with the usage of every call
+	recordUsage func(job *storage.Job, model string, usage openai.Usage)
+}
+
+func daemonEnv(db *sql.DB) classifyEnv {
+	return classifyEnv{
+		db:    db,
+		model: classificationModel,
+		cache: true,
+		recordUsage: func(job *storage.Job, model string, usage openai.Usage) {
+			recordUsage(db, job, model, usage)
+		},
+	}
+}
+
+// classifyJob classifies a job after the rules stage: rules that skip the LLM, then classifyDocument
+// and the rules on the sender the LLM read
+func classifyJob(env classifyEnv, pc *PipelineContext) error {
+	rules, err := ruleResultOf(pc)
+	if err != nil {
+		return err
+	}
+
+	var classification storage.Classification
+	if rules.SkipLLM {
+		pc.Logger.Info("Classified by rules", "rules", rules.Rules, "category", rules.Category)
+		pc.SetArtifact("classifier", "rules")
+		classification = fallbackClassification(pc.Job.File)
+	} else {
+		classification, err = classifyDocument(env, pc, rules.Hints)
+		if err != nil {
+			return err
+		}
+
+		if classification.Sender != "" {
+			rules, err = senderRules(pc, classification.Sender)
 			if err != nil {
-				slog.Error("Error classifying file", "error", err)
-				sendTelegramMessage(user, fmt.Sprintf("Error classifying file: %s", err))
-				sendTelegramMessage(user, fmt.Sprintf("%d tries left", maxTries-i))
-				time.Sleep(delay)
-				continue
+				return err
 			}
+		}
+	}
 
-			var providerName string
-			var downloadURL string
-			if viper.IsSet(fmt.Sprintf("%s.nextcloud", user)) {
-				providerName = "Nextcloud"
-				downloadURL, err = uploadFileToNextcloud(user, classification, fileName)
-			} else if viper.IsSet(fmt.Sprintf("%s.google_drive", user)) {
-				providerName = "Google Drive"
-				downloadURL, err = uploadFileToGoogleDrive(user, classification, fileName)
-			} else {
-				slog.Error("No cloud storage provider set", "user", user)
-				sendTelegramMessage(user, "No cloud storage provider set")
-				break
-			}
+	pc.Job.Classification, err = rules.apply(pc.Job, classification)
+	return err
+}
 
-			if err != nil {
-				slog.Error("Error uploading file", "provider", providerName, "error", err)
-				sendTelegramMessage(user, fmt.Sprintf("Error uploading file: <pre>%s</pre>", err))
-				sendTelegramMessage(user, fmt.Sprintf("%d tries left", maxTries-i))
-				time.Sleep(delay)
-				continue
+// classifyDocument classifies the OCR text of a job with the cache, the offline classifier, the
+// k-NN vote or the LLM
+func classifyDocument(env classifyEnv, pc *PipelineContext, hints []string) (storage.Classification, error) {
+	spent, err := storage.MonthlyCost(env.db, pc.Job.User, time.Now())
+	if err != nil {
+		return storage.Classification{}, err
+	}
+
+	b := userBudget(pc.Job.User)
+	model := b.model(spent)
+	if model == classificationModel {
+		model = env.model
+	}
+
+	v, shadow, err := chooseVariant(pc.Job, env.prompt, model)
+	if err != nil {
+		return storage.Classification{}, err
+	}
+
+	// a classification of the regular model is always good enough, variant B needs its own
+	models := []string{env.model}
+	if v.Name == variantB {
+		models = []string{v.Model}
+	} else if model == "" {
+		models = append(models, b.Model)
+	} else if model != env.model {
+		models = append(models, model)
+	}
+
+	// hints change the answer, so cached classifications without them don't apply
+	if env.cache && len(hints) == 0 {
+		classification, cachedModel, ok, err := cachedClassification(env.db, pc, v.Prompt, models...)
+		if err != nil {
+			return storage.Classification{}, err
+		}
+		if ok {
+			pc.Job.Model = cachedModel
+			pc.Job.PromptVersion = v.Prompt.ID()
+			pc.Job.Variant = v.Name
+			if shadow != nil {
+				shadowClassify(env, pc, *shadow, promptContext{}, classification.Category)
+			}
+			// cached documents are neighbours for the k-NN vote like any other
+			if knnEnabled() {
+				embedJob(env, pc)
 			}
+			pc.SetArtifact("classifier", "llm")
+			return classification, nil
+		}
+	}
+
+	mode := offlineMode()
+	if mode == offlineOnly || mode == offlinePrefilter {
+		offline, p, ok := classifyOffline(pc.Job.File, pc.Job.OCR)
+		if !ok && mode == offlineOnly {
+			return storage.Classification{}, fmt.Errorf("no offline classifier at %s", offlineModelPath())
+		}
 
-			err = sendTelegramMessage(user, fmt.Sprintf(`Classified file: %s
+		viper.SetDefault("classifier.threshold", 0.9)
+		if ok && (mode == offlineOnly || p.Confidence >= viper.GetFloat64("classifier.threshold")) {
+			pc.Logger.Info("Classified offline", "category", p.Category, "confidence", p.Confidence)
+			pc.SetArtifact("classifier", "offline")
+			return offline, nil
+		}
+	}
 
-<b>%s</b>
+	if model == "" {
+		pc.Logger.Warn("Monthly budget exhausted, using local fallback", "spent", spent, "budget", b.Hard)
+		return localFallback(pc, mode), nil
+	}
 
-<blockquote><b>Category: %s</b></blockquote>
+	if knnEnabled() {
+		classification, ok := classifyKNN(env, pc)
+		if ok {
+			pc.Logger.Info("Classified by k-NN vote", "category", classification.Category)
+			pc.SetArtifact("classifier", "knn")
+			return classification, nil
+		}
+	}
 
-You can download it from <a href="%s">%s</a>`, entry.Name, classification.Title, classification.Category, downloadURL, providerName))
-			if err != nil {
-				slog.Error("Error sending Telegram message", "error", err)
+	if model != env.model {
+		pc.Logger.Info("Monthly budget reached, using cheaper model", "model", model, "spent", spent, "budget", b.Soft)
+	}
+	if v.Name != "" {
+		pc.Logger.Debug("Experiment variant", "variant", v.Name, "prompt", v.Prompt.ID(), "model", v.Model)
+	}
+
+	examples, err := fewShotExamples(env.db, pc.Job)
+	if err != nil {
+		pc.Logger.Warn("Error finding few-shot examples", "error", err)
+	}
+	if len(examples) > 0 {
+		pc.Logger.Debug("Adding few-shot examples", "examples", len(examples))
+	}
+
+	pctx := promptContext{Prompt: v.Prompt, Hints: hints, Examples: examples, Recipient: routingEnabled()}
+	classification, usage, err := classifyText(pc.Context, v.Model, pc.Job.OCR, pctx)
+	// failed calls cost tokens too
+	if usage.TotalTokens > 0 {
+		env.recordUsage(pc.Job, v.Model, usage)
+	}
+	if err != nil {
+		// the LLM is unavailable, don't let the job die if the offline classifier can take over. Without
+		// a trained model the job dead-letters and the user is told instead of filing it as misc.
+		if mode != offlineOff && pc.Context.Err() == nil && pc.Job.Attempts+1 >= maxAttempts() {
+			if offline, p, ok := classifyOffline(pc.Job.File, pc.Job.OCR); ok {
+				pc.Logger.Warn("LLM failed on the last attempt, classified offline", "error", err, "category", p.Category, "confidence", p.Confidence)
+				pc.SetArtifact("classifier", "offline")
+				return offline, nil
 			}
+		}
+		return storage.Classification{}, err
+	}
 
-			break
+	if hash := pc.Artifact("sha256"); env.cache && hash != "" && len(hints) == 0 {
+		err = storage.CacheClassification(env.db, hash, classification, v.Prompt.Version(), v.Model)
+		if err != nil {
+			pc.Logger.Warn("Error caching classification", "error", err)
 		}
 	}
 
-	// clear knownFiles
-	knownFiles = make(map[string]bool)
-	for _, entry := range entries {
-		if entry.Type == ftp.EntryTypeFile {
-			knownFiles[entry.Name] = true
+	pc.Job.Model = v.Model
+	pc.Job.PromptVersion = v.Prompt.ID()
+	pc.Job.Variant = v.Name
+	if shadow != nil {
+		shadowClassify(env, pc, *shadow, pctx, classification.Category)
+	}
+
+	pc.SetArtifact("classifier", "llm")
+	return classification, nil
+}
+
+// localFallback classifies without the LLM, using the offline classifier if there is one
+func localFallback(pc *PipelineContext, mode string) storage.Classification {
+	if mode != offlineOff {
+		if classification, p, ok := classifyOffline(pc.Job.File, pc.Job.OCR); ok {
+			pc.Logger.Info("Classified offline", "category", p.Category, "confidence", p.Confidence)
+			pc.SetArtifact("classifier", "offline")
+			return classification
+		}
+	}
+
+	pc.SetArtifact("classifier", "fallback")
+	return fallbackClassification(pc.Job.File)
+}
+
+func uploadStage(db *sql.DB, pc *PipelineContext) error {
+	job := pc.Job
+	user := job.User
+	classification := job.Classification
+	fileName := job.LocalFile
+
+	rules, err := ruleResultOf(pc)
+	if err != nil {
+		return err
+	}
+
+	if pc.Artifact("rerouted") != "" {
+		pc.Logger.Info("Skipping upload of document for another user", "recipients", pc.Artifact("routed_to"))
+		return nil
+	}
+
+	path := pathTemplate(user)
+	path.Override = rules.Destination
+	var tags []string
+	switch pc.Artifact("duplicate_action") {
+	case duplicateSkip:
+		pc.Logger.Info("Skipping upload of duplicate", "original", job.DuplicateOf)
+		return nil
+	case duplicateFolder:
+		path.Folder = duplicatesFolder
+		tags = append(tags, duplicatesFolder)
+	}
+
+	var providerName string
+	var stored storage.StoredFile
+	if viper.IsSet(fmt.Sprintf("%s.nextcloud", user)) {
+		providerName = "Nextcloud"
+		stored, err = uploadFileToNextcloud(pc.Context, user, path, classification, fileName)
+	} else if viper.IsSet(fmt.Sprintf("users.%s.webdav", user)) {
+		providerName = "WebDAV"
+		stored, err = uploadFileToWebDAV(pc.Context, user, path, classification, fileName)
+	} else if viper.IsSet(fmt.Sprintf("users.%s.paperless", user)) {
+		providerName = "Paperless"
+		stored, err = uploadFileToPaperless(pc.Context, user, tags, classification, fileName)
+	} else if viper.IsSet(fmt.Sprintf("users.%s.google_drive", user)) {
+		providerName = "Google Drive"
+		stored, err = uploadFileToGoogleDrive(pc.Context, db, user, path, classification, fileName)
+	} else {
+		slog.Error("No cloud storage provider set", "user", user)
+		return errors.New("No cloud storage provider set")
+	}
+
+	if err != nil {
+		slog.Error("Error uploading file", "provider", providerName, "error", err)
+		return err
+	}
+
+	job.Provider = providerName
+	job.Path = stored.Path
+	job.URL = stored.URL
+	job.Duplicate = stored.Duplicate
+	return nil
+}
+
+func notifyStage(pc *PipelineContext) error {
+	job := pc.Job
+
+	var err error
+	if !telegramConfigured(job.User) {
+		slog.Debug("Telegram not configured, skipping notification", "user", job.User)
+	} else if pc.Artifact("rerouted") != "" {
+		err = sendTelegramMessage(job.User, fmt.Sprintf(`Rerouted file: %s
+
+<b>%s</b> is addressed to %s and was filed for them`, html.EscapeString(job.File), html.EscapeString(job.Classification.Title), html.EscapeString(strings.Join(strings.Split(pc.Artifact("routed_to"), ","), " and "))))
+	} else if job.DuplicateOf != 0 && job.Duplicate {
+		err = sendTelegramMessage(job.User, fmt.Sprintf(`Skipped duplicate: %s
+
+<b>%s</b> is %.0f%% similar to a document that is already in the archive at <a href="%s">%s</a>`, html.EscapeString(job.File), html.EscapeString(job.Classification.Title), job.Similarity*100, html.EscapeString(job.URL), html.EscapeString(job.Path)))
+	} else if job.Duplicate {
+		err = sendTelegramMessage(job.User, fmt.Sprintf(`Skipped file: %s
+
+<b>%s</b> already exists with the same content at <a href="%s">%s</a>`, html.EscapeString(job.File), html.EscapeString(job.Classification.Title), html.EscapeString(job.URL), html.EscapeString(job.Path)))
+	} else {
+		var routing string
+		if from := pc.Artifact("routed_from"); from != "" {
+			routing = fmt.Sprintf("\n\nScanned by %s, it is addressed to you", html.EscapeString(from))
+		} else if to := pc.Artifact("routed_to"); to != "" {
+			routing = fmt.Sprintf("\n\nAlso filed for %s", html.EscapeString(strings.Join(strings.Split(to, ","), " and ")))
 		}
+
+		// confirmations and corrections are used as examples for later documents
+		err = sendTelegramQuestion(job.User, fmt.Sprintf(`Classified file: %s
+
+<b>%s</b>
+
+<blockquote><b>Category: %s</b></blockquote>
+
+You can download it from <a href="%s">%s</a>%s`, html.EscapeString(job.File), html.EscapeString(job.Classification.Title), html.EscapeString(job.Classification.Category),
+			html.EscapeString(job.URL), job.Provider, routing), confirmKeyboard(job))
 	}
+	if err != nil {
+		// the document is stored, a failed notification must not retry the upload
+		pc.Logger.Warn("Error sending Telegram message", "error", err)
+	}
+
+	// the job is done, the spooled file is not needed anymore
+	err = os.Remove(job.LocalFile)
+	if err != nil {
+		slog.Warn("Error removing spooled file", "file", job.LocalFile, "error", err)
+	}
+
+	return nil
 }
 
-func uploadFileToGoogleDrive(user string, classification storage.Classification, localFilePath string) (string, error) {
-    // get email from config
-    if !viper.IsSet(fmt.Sprintf("users.%s.google_drive.email", user)) {
-        return "", errors.New("Google Drive email not set for user")
-    }
+func uploadFileToGoogleDrive(ctx context.Context, db *sql.DB, user string, path storage.PathTemplate, classification storage.Classification, localFilePath string) (storage.StoredFile, error) {
+	// get email from config
+	if !viper.IsSet(fmt.Sprintf("users.%s.google_drive.email", user)) {
+		return storage.StoredFile{}, errors.New("Google Drive email not set for user")
+	}
 
-    email := viper.GetString(fmt.Sprintf("users.%s.google_drive.email", user))
+	email := viper.GetString(fmt.Sprintf("users.%s.google_drive.email", user))
 
-    storage.StoreFile(email, localFilePath, classification)
+	data, err := os.ReadFile(localFilePath)
+	if err != nil {
+		slog.Error("Error reading local file", "error", err)
+		return storage.StoredFile{}, err
+	}
+
+	config, err := storage.LoadOAuth2Config("creds.json")
+	if err != nil {
+		slog.Error("Error loading Google client config", "error", err)
+		return storage.StoredFile{}, err
+	}
+
+	drive := &storage.GoogleDrive{
+		DB:        db,
+		Config:    config,
+		UserID:    email,
+		Path:      path,
+		Collision: collisionStrategy(user),
+	}
+
+	return drive.StoreFile(ctx, data, classification)
+}
+
+// pathTemplate returns the destination path template of a user, per-category templates take precedence
+func pathTemplate(user string) storage.PathTemplate {
+	return storage.PathTemplate{
+		Default:    viper.GetString(fmt.Sprintf("users.%s.path_template", user)),
+		Categories: viper.GetStringMapString(fmt.Sprintf("users.%s.path_templates", user)),
+		User:       user,
+	}
+}
+
+// collisionStrategy returns what to do if a different file with the same name already exists
+func collisionStrategy(user string) storage.CollisionStrategy {
+	return storage.CollisionStrategy(viper.GetString(fmt.Sprintf("users.%s.on_collision", user)))
+}
+
+// validateCollisionStrategies checks the collision strategies of all users so typos show up on startup
+func validateCollisionStrategies() error {
+	for user := range viper.GetStringMap("users") {
+		_, err := storage.ParseCollisionStrategy(string(collisionStrategy(user)))
+		if err != nil {
+			return fmt.Errorf("user %s: %w", user, err)
+		}
+	}
+
+	return nil
 }
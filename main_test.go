@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"3nt3/ai-scan-classifier/storage"
+
+	"github.com/jlaffaye/ftp"
+)
+
+type fakeFTP map[string][]*ftp.Entry
+
+func (f fakeFTP) List(path string) ([]*ftp.Entry, error) {
+	return f[path], nil
+}
+
+func TestProcessUserFolder(t *testing.T) {
+	db, err := storage.OpenDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	modified := time.Date(2024, 5, 2, 9, 30, 0, 0, time.UTC)
+	c := fakeFTP{"/scans/alice": {
+		{Name: "scan.pdf", Type: ftp.EntryTypeFile, Size: 1024, Time: modified},
+		{Name: "old", Type: ftp.EntryTypeFolder},
+	}}
+
+	var mu sync.Mutex
+	processUserFolder(db, c, &mu, "/scans", "alice", "download")
+	processUserFolder(db, c, &mu, "/scans", "alice", "download")
+
+	jobs, err := storage.ListJobs(db, storage.JobFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].User != "alice" || jobs[0].File != "scan.pdf" || jobs[0].Stage != "download" {
+		t.Fatalf("jobs = %+v", jobs)
+	}
+
+	// a new scan with the same name is a new job once the first one is done
+	_, err = db.Exec(`UPDATE jobs SET state = ?`, storage.JobDone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c["/scans/alice"][0].Time = modified.Add(time.Hour)
+	processUserFolder(db, c, &mu, "/scans", "alice", "download")
+
+	jobs, err = storage.ListJobs(db, storage.JobFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Errorf("%d jobs, want 2", len(jobs))
+	}
+}
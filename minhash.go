@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/fnv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// shingleSize is the number of words per shingle
+	shingleSize = 3
+	// signatureSize is the number of hash functions of a MinHash signature
+	signatureSize = 128
+)
+
+// minHashSeeds are the parameters of the hash functions, derived with splitmix64 so signatures stay comparable across restarts
+var minHashSeeds = func() [signatureSize][2]uint64 {
+	var seeds [signatureSize][2]uint64
+
+	state := uint64(0x5ca11ab1e)
+	next := func() uint64 {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		return z ^ (z >> 31)
+	}
+
+	for i := range seeds {
+		seeds[i] = [2]uint64{next() | 1, next()}
+	}
+	return seeds
+}()
+
+// shingles returns the hashes of all overlapping word sequences of a text. Case, punctuation and
+// whitespace are ignored because OCR of two scans of the same letter rarely agrees on them.
+func shingles(text string) map[uint64]struct{} {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	result := make(map[uint64]struct{})
+	add := func(shingle []string) {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(shingle, " ")))
+		result[h.Sum64()] = struct{}{}
+	}
+
+	// very short texts are a single shingle
+	if len(words) > 0 && len(words) < shingleSize {
+		add(words)
+	}
+	for i := 0; i+shingleSize <= len(words); i++ {
+		add(words[i : i+shingleSize])
+	}
+
+	return result
+}
+
+// minHash returns the hex encoded MinHash signature of a text, or "" if the text has no words
+func minHash(text string) string {
+	set := shingles(text)
+	if len(set) == 0 {
+		return ""
+	}
+
+	var signature [signatureSize]uint32
+	for i := range signature {
+		signature[i] = ^uint32(0)
+	}
+
+	for shingle := range set {
+		for i, seed := range minHashSeeds {
+			if h := uint32((shingle*seed[0] + seed[1]) >> 32); h < signature[i] {
+				signature[i] = h
+			}
+		}
+	}
+
+	buf := make([]byte, 4*signatureSize)
+	for i, v := range signature {
+		binary.BigEndian.PutUint32(buf[4*i:], v)
+	}
+
+	return hex.EncodeToString(buf)
+}
+
+// similarity estimates the Jaccard similarity of the shingles of two texts from their signatures
+func similarity(a string, b string) float64 {
+	x, err := hex.DecodeString(a)
+	if err != nil || len(x) != 4*signatureSize {
+		return 0
+	}
+	y, err := hex.DecodeString(b)
+	if err != nil || len(y) != 4*signatureSize {
+		return 0
+	}
+
+	equal := 0
+	for i := 0; i < signatureSize; i++ {
+		if binary.BigEndian.Uint32(x[4*i:]) == binary.BigEndian.Uint32(y[4*i:]) {
+			equal++
+		}
+	}
+
+	return float64(equal) / signatureSize
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const minHashLetter = `Techniker Krankenkasse, Bramfelder Straße 140, 22305 Hamburg. Sehr geehrte Frau Example,
+Ihr Beitrag zur Kranken- und Pflegeversicherung ändert sich ab dem 1. Januar. Der neue monatliche
+Beitrag beträgt 412,35 Euro und wird wie bisher von Ihrem Konto abgebucht. Bei Fragen erreichen Sie
+uns unter der Telefonnummer auf der Rückseite. Mit freundlichen Grüßen, Ihre Techniker Krankenkasse`
+
+func TestMinHashSimilarity(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     string
+		min, max float64
+	}{
+		{name: "identical", a: minHashLetter, b: minHashLetter, min: 1, max: 1},
+		// OCR of a second scan disagrees on case, line breaks and a few characters, it still passes the
+		// default duplicates.threshold
+		{name: "rescanned", a: minHashLetter, b: strings.ToUpper(strings.NewReplacer("\n", " ", "412,35", "412.35", "Januar", "Januor").Replace(minHashLetter)), min: 0.8, max: 1},
+		{name: "unrelated", a: minHashLetter, b: `Stadtwerke Köln GmbH, Jahresabrechnung Strom für den Zeitraum vom 01.01. bis 31.12.
+Ihr Verbrauch betrug 2.134 kWh, daraus ergibt sich ein Guthaben von 54,20 Euro, das wir Ihrem Konto gutschreiben.`, min: 0, max: 0.1},
+		{name: "short", a: "Kündigung", b: "kündigung!", min: 1, max: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := similarity(minHash(test.a), minHash(test.b))
+			if s < test.min || s > test.max {
+				t.Errorf("similarity = %.2f, want %.2f to %.2f", s, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestMinHashEmpty(t *testing.T) {
+	if sig := minHash(" ,.\f "); sig != "" {
+		t.Errorf("signature of a text without words = %q", sig)
+	}
+
+	sig := minHash(minHashLetter)
+	if len(sig) != 8*signatureSize {
+		t.Fatalf("signature has %d hex digits, want %d", len(sig), 8*signatureSize)
+	}
+	// signatures of texts without words or from other versions never match
+	for _, other := range []string{"", "abc", sig[:len(sig)-8]} {
+		if s := similarity(sig, other); s != 0 {
+			t.Errorf("similarity to %q = %.2f, want 0", other, s)
+		}
+	}
+}
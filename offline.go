@@ -0,0 +1,379 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/classifier"
+	"3nt3/ai-scan-classifier/storage"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/urfave/cli/v2"
+)
+
+// how the offline classifier is used, configured with "classifier.mode"
+const (
+	// offlineOff never uses the offline classifier
+	offlineOff = "off"
+	// offlineFallback uses it when the LLM is unavailable or the budget is exhausted
+	offlineFallback = "fallback"
+	// offlinePrefilter skips the LLM if the offline classifier is confident enough
+	offlinePrefilter = "prefilter"
+	// offlineOnly never asks the LLM
+	offlineOnly = "only"
+)
+
+func offlineMode() string {
+	viper.SetDefault("classifier.mode", offlineFallback)
+	return viper.GetString("classifier.mode")
+}
+
+func offlineModelPath() string {
+	viper.SetDefault("classifier.model", "./classifier.json")
+	return viper.GetString("classifier.model")
+}
+
+var (
+	offlineMu      sync.Mutex
+	offlineCached  *classifier.Model
+	offlineModTime time.Time
+)
+
+// offlineModel returns the trained model, it is reloaded when the file changes so the daemon
+// picks up a retrained model without a restart. It returns nil if there is no model.
+func offlineModel() *classifier.Model {
+	offlineMu.Lock()
+	defer offlineMu.Unlock()
+
+	path := offlineModelPath()
+	info, err := os.Stat(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Error reading offline classifier", "path", path, "error", err)
+		}
+		offlineCached = nil
+		return nil
+	}
+
+	if offlineCached != nil && info.ModTime().Equal(offlineModTime) {
+		return offlineCached
+	}
+
+	m, err := classifier.Load(path)
+	if err != nil {
+		slog.Warn("Error loading offline classifier", "path", path, "error", err)
+		return offlineCached
+	}
+
+	slog.Info("Loaded offline classifier", "path", path, "categories", len(m.Categories), "documents", m.Documents, "trained_at", m.TrainedAt)
+	offlineCached = m
+	offlineModTime = info.ModTime()
+	return m
+}
+
+// classifyOffline returns the offline classification of a document and whether a model is available
+func classifyOffline(file string, ocr string) (storage.Classification, classifier.Prediction, bool) {
+	m := offlineModel()
+	if m == nil {
+		return storage.Classification{}, classifier.Prediction{}, false
+	}
+
+	p := m.Predict(ocr)
+
+	classification := fallbackClassification(file)
+	classification.Category = p.Category
+	classification.Explanation = fmt.Sprintf("Classified offline as %s with %.0f%% confidence", p.Category, p.Confidence*100)
+
+	return classification, p, true
+}
+
+// labelledFile is a document in a directory with one folder per category
+type labelledFile struct {
+	Path     string
+	Category string
+}
+
+// labelledFiles lists the PDFs and text files in a directory with one folder per category,
+// e.g. Documents/scans/<category>/... Text sidecars of PDFs are not listed on their own.
+func labelledFiles(dir string) ([]labelledFile, error) {
+	var files []labelledFile
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		if len(segments) < 2 {
+			slog.Debug("Skipping file outside of a category folder", "file", rel)
+			return nil
+		}
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".pdf":
+		case ".txt":
+			// sidecar files of PDFs are used by exampleText
+			if _, err := os.Stat(strings.TrimSuffix(path, filepath.Ext(path))); err == nil {
+				return nil
+			}
+		default:
+			return nil
+		}
+
+		files = append(files, labelledFile{Path: path, Category: segments[0]})
+		return nil
+	})
+
+	return files, err
+}
+
+// text returns the text of a labelled file, PDFs are OCRed using the cache if possible
+func (f labelledFile) text(ctx context.Context, db *sql.DB) (string, error) {
+	if strings.ToLower(filepath.Ext(f.Path)) == ".pdf" {
+		return exampleText(ctx, db, f.Path)
+	}
+
+	b, err := os.ReadFile(f.Path)
+	return string(b), err
+}
+
+// directoryExamples reads labelled documents from a directory with one folder per category
+func directoryExamples(ctx context.Context, db *sql.DB, dir string) ([]classifier.Example, error) {
+	files, err := labelledFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var examples []classifier.Example
+	for _, f := range files {
+		text, err := f.text(ctx, db)
+		if err != nil {
+			slog.Warn("Skipping file that can't be OCRed", "file", f.Path, "error", err)
+			continue
+		}
+
+		examples = append(examples, classifier.Example{Text: text, Category: f.Category})
+	}
+
+	return examples, nil
+}
+
+// exampleText returns the text of a PDF from its sidecar file, the cache or OCR
+func exampleText(ctx context.Context, db *sql.DB, path string) (string, error) {
+	if b, err := os.ReadFile(path + ".txt"); err == nil {
+		return string(b), nil
+	}
+
+	hash, err := fileHash(path)
+	if err != nil {
+		return "", err
+	}
+
+	entry, err := storage.GetCacheEntry(db, hash)
+	if err != nil {
+		return "", err
+	}
+	if entry != nil && entry.OCR != "" {
+		return entry.OCR, nil
+	}
+
+	// labelled files are only read, the pages are not corrected
+	ocr, _, err := ocrFile(ctx, path, ocrOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	err = storage.CacheOCR(db, hash, ocr)
+	if err != nil {
+		slog.Warn("Error caching OCR text", "error", err)
+	}
+
+	return ocr, nil
+}
+
+// historyExamples returns the finished jobs that were classified by the LLM or rules, or confirmed by the user
+func historyExamples(db *sql.DB) ([]classifier.Example, error) {
+	jobs, err := storage.ClassifiedJobs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var examples []classifier.Example
+	for _, job := range jobs {
+		// never learn from our own guesses
+		if source := job.Artifacts["classifier"]; !job.Confirmed && source != "" && source != "llm" && source != "rules" {
+			continue
+		}
+		examples = append(examples, classifier.Example{Text: job.OCR, Category: job.Classification.Category})
+	}
+
+	return examples, nil
+}
+
+var datasetFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "dir",
+		Usage: "Directory with one folder of documents per category",
+	},
+	&cli.BoolFlag{
+		Name:  "history",
+		Usage: "Use the documents classified by the LLM or rules or confirmed by the user in the job history",
+	},
+}
+
+// loadDataset collects the examples selected by datasetFlags
+func loadDataset(c *cli.Context, db *sql.DB) ([]classifier.Example, error) {
+	if !c.IsSet("dir") && !c.Bool("history") {
+		return nil, errors.New("no dataset, use --dir and/or --history")
+	}
+
+	var examples []classifier.Example
+	if c.IsSet("dir") {
+		dirExamples, err := directoryExamples(c.Context, db, c.String("dir"))
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Loaded examples from directory", "dir", c.String("dir"), "examples", len(dirExamples))
+		examples = append(examples, dirExamples...)
+	}
+
+	if c.Bool("history") {
+		jobExamples, err := historyExamples(db)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Loaded examples from job history", "examples", len(jobExamples))
+		examples = append(examples, jobExamples...)
+	}
+
+	return examples, nil
+}
+
+func printReport(out io.Writer, report classifier.Report) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CATEGORY\tSUPPORT\tPRECISION\tRECALL")
+	for _, r := range report.Categories {
+		fmt.Fprintf(w, "%s\t%d\t%.2f\t%.2f\n", r.Category, r.Support, r.Precision, r.Recall)
+	}
+	fmt.Fprintf(w, "\nAccuracy: %.2f (%d/%d)\n", report.Accuracy, report.Correct, report.Examples)
+
+	return w.Flush()
+}
+
+var classifierCommand = &cli.Command{
+	Name:  "classifier",
+	Usage: "Train and evaluate the offline classifier",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "train",
+			Usage: "Train the offline classifier and save it",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "Where to save the model, defaults to classifier.model from the config",
+				},
+			}, datasetFlags...),
+			Action: func(c *cli.Context) error {
+				err := loadConfig()
+				if err != nil {
+					return err
+				}
+
+				db, err := storage.OpenDB(viperDatabase())
+				if err != nil {
+					slog.Error("Error opening database", "error", err)
+					return err
+				}
+				defer db.Close()
+
+				examples, err := loadDataset(c, db)
+				if err != nil {
+					return err
+				}
+
+				m, err := classifier.Train(examples)
+				if err != nil {
+					return err
+				}
+
+				output := offlineModelPath()
+				if c.IsSet("output") {
+					output = c.String("output")
+				}
+
+				err = m.Save(output)
+				if err != nil {
+					return err
+				}
+
+				slog.Info("Saved offline classifier", "path", output, "categories", len(m.Categories), "vocabulary", len(m.Vocabulary), "documents", m.Documents)
+				return nil
+			},
+		},
+		{
+			Name:  "eval",
+			Usage: "Evaluate the offline classifier on held-out documents",
+			Flags: append([]cli.Flag{
+				&cli.Float64Flag{
+					Name:  "test-fraction",
+					Usage: "Fraction of every category that is held out for testing",
+					Value: 0.2,
+				},
+				&cli.BoolFlag{
+					Name:  "model",
+					Usage: "Evaluate the saved model on the whole dataset instead of training a new one",
+				},
+			}, datasetFlags...),
+			Action: func(c *cli.Context) error {
+				err := loadConfig()
+				if err != nil {
+					return err
+				}
+
+				db, err := storage.OpenDB(viperDatabase())
+				if err != nil {
+					slog.Error("Error opening database", "error", err)
+					return err
+				}
+				defer db.Close()
+
+				examples, err := loadDataset(c, db)
+				if err != nil {
+					return err
+				}
+
+				if c.Bool("model") {
+					m := offlineModel()
+					if m == nil {
+						return fmt.Errorf("no model at %s, train one first", offlineModelPath())
+					}
+					return printReport(os.Stdout, classifier.Evaluate(m, examples))
+				}
+
+				train, test := classifier.Split(examples, c.Float64("test-fraction"), 1)
+				m, err := classifier.Train(train)
+				if err != nil {
+					return err
+				}
+
+				slog.Info("Trained model for evaluation", "train", len(train), "test", len(test))
+				return printReport(os.Stdout, classifier.Evaluate(m, test))
+			},
+		},
+	},
+}
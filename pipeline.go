@@ -0,0 +1,299 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/storage"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// PipelineContext carries a job, its artifacts and its classification through the stages
+type PipelineContext struct {
+	// Context is cancelled when the daemon shuts down and running jobs have to be aborted
+	Context context.Context
+	Job     *storage.Job
+	Stage   string
+	Logger  *slog.Logger
+}
+
+// Artifact returns an artifact stored by an earlier stage
+func (pc *PipelineContext) Artifact(name string) string {
+	return pc.Job.Artifacts[name]
+}
+
+// SetArtifact stores an artifact for later stages, it is persisted with the job
+func (pc *PipelineContext) SetArtifact(name string, value string) {
+	if pc.Job.Artifacts == nil {
+		pc.Job.Artifacts = make(map[string]string)
+	}
+	pc.Job.Artifacts[name] = value
+}
+
+// Stage is a single named step of the pipeline
+type Stage interface {
+	Name() string
+	// Pool is the worker pool the stage runs in
+	Pool() string
+	Run(pc *PipelineContext) error
+}
+
+// StageFunc runs a stage, middleware wraps it
+type StageFunc func(pc *PipelineContext) error
+
+// Middleware wraps every stage run, e.g. for logging, timing, metrics or error handling
+type Middleware func(next StageFunc) StageFunc
+
+// funcStage adapts a function to the Stage interface
+type funcStage struct {
+	name string
+	pool string
+	run  StageFunc
+}
+
+func (s funcStage) Name() string                  { return s.name }
+func (s funcStage) Pool() string                  { return s.pool }
+func (s funcStage) Run(pc *PipelineContext) error { return s.run(pc) }
+
+// Pipeline is the ordered list of stages every job goes through
+type Pipeline struct {
+	stages     []Stage
+	middleware []Middleware
+}
+
+// Use adds middleware, the first one added is the outermost
+func (p *Pipeline) Use(middleware ...Middleware) {
+	p.middleware = append(p.middleware, middleware...)
+}
+
+// First returns the name of the first stage
+func (p *Pipeline) First() string {
+	if len(p.stages) == 0 {
+		return storage.StageDone
+	}
+	return p.stages[0].Name()
+}
+
+// Next returns the name of the stage after the given one
+func (p *Pipeline) Next(name string) string {
+	for i, stage := range p.stages {
+		if stage.Name() == name && i+1 < len(p.stages) {
+			return p.stages[i+1].Name()
+		}
+	}
+	return storage.StageDone
+}
+
+// Stage returns the stage with the given name
+func (p *Pipeline) Stage(name string) (Stage, bool) {
+	for _, stage := range p.stages {
+		if stage.Name() == name {
+			return stage, true
+		}
+	}
+	return nil, false
+}
+
+// Pools returns the stage names of every worker pool
+func (p *Pipeline) Pools() map[string][]string {
+	pools := make(map[string][]string)
+	for _, stage := range p.stages {
+		pools[stage.Pool()] = append(pools[stage.Pool()], stage.Name())
+	}
+	return pools
+}
+
+// Run runs a stage of the job wrapped in all middleware
+func (p *Pipeline) Run(ctx context.Context, stage Stage, job *storage.Job) error {
+	pc := &PipelineContext{
+		Context: ctx,
+		Job:     job,
+		Stage:   stage.Name(),
+		Logger:  slog.With("job", job.ID, "user", job.User, "stage", stage.Name()),
+	}
+
+	run := StageFunc(stage.Run)
+	for i := len(p.middleware) - 1; i >= 0; i-- {
+		run = p.middleware[i](run)
+	}
+
+	return run(pc)
+}
+
+// newPipeline builds the pipeline from the "pipeline" config. Entries are either the name of a
+// built-in stage or a command stage:
+//
+//	pipeline:
+//	  - download
+//	  - name: redact
+//	    command: ["redact-pii", "{file}"]
+//	  - ocr
+func newPipeline(builtin []Stage) (*Pipeline, error) {
+	pipeline := &Pipeline{}
+
+	if !viper.IsSet("pipeline") {
+		pipeline.stages = builtin
+		return pipeline, nil
+	}
+
+	entries, ok := viper.Get("pipeline").([]any)
+	if !ok {
+		return nil, errors.New("pipeline must be a list of stages")
+	}
+
+	for _, entry := range entries {
+		switch entry := entry.(type) {
+		case string:
+			stage, ok := findStage(builtin, entry)
+			if !ok {
+				return nil, fmt.Errorf("unknown stage %s", entry)
+			}
+			pipeline.stages = append(pipeline.stages, stage)
+		case map[string]any:
+			stage, err := newCommandStage(entry)
+			if err != nil {
+				return nil, err
+			}
+			pipeline.stages = append(pipeline.stages, stage)
+		default:
+			return nil, fmt.Errorf("invalid pipeline entry %v", entry)
+		}
+	}
+
+	for i, stage := range pipeline.stages {
+		if stage.Name() == storage.StageDone {
+			return nil, fmt.Errorf("stage name %s is reserved", storage.StageDone)
+		}
+		for _, other := range pipeline.stages[:i] {
+			if other.Name() == stage.Name() {
+				return nil, fmt.Errorf("duplicate stage %s", stage.Name())
+			}
+		}
+	}
+
+	return pipeline, nil
+}
+
+func findStage(stages []Stage, name string) (Stage, bool) {
+	for _, stage := range stages {
+		if stage.Name() == name {
+			return stage, true
+		}
+	}
+	return nil, false
+}
+
+// newCommandStage creates a stage that runs an external command on the spooled file.
+// "{file}" in the arguments is replaced with the path of the file.
+func newCommandStage(config map[string]any) (Stage, error) {
+	name, _ := config["name"].(string)
+	if name == "" {
+		return nil, errors.New("command stage without name")
+	}
+
+	rawCommand, _ := config["command"].([]any)
+	if len(rawCommand) == 0 {
+		return nil, fmt.Errorf("command stage %s without command", name)
+	}
+
+	var command []string
+	for _, arg := range rawCommand {
+		command = append(command, fmt.Sprint(arg))
+	}
+
+	pool, _ := config["pool"].(string)
+	if pool == "" {
+		pool = "default"
+	}
+
+	return funcStage{name, pool, func(pc *PipelineContext) error {
+		args := make([]string, len(command))
+		for i, arg := range command {
+			args[i] = strings.ReplaceAll(arg, "{file}", pc.Job.LocalFile)
+		}
+
+		cmd := exec.CommandContext(pc.Context, args[0], args[1:]...)
+		cmd.Env = append(os.Environ(),
+			fmt.Sprintf("JOB_ID=%d", pc.Job.ID),
+			fmt.Sprintf("JOB_USER=%s", pc.Job.User),
+			fmt.Sprintf("JOB_FILE=%s", pc.Job.File),
+		)
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			pc.Logger.Error("Error running command stage", "error", err, "output", string(output))
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		pc.SetArtifact(name, strings.TrimSpace(string(output)))
+		return nil
+	}}, nil
+}
+
+var (
+	stageRuns     = expvar.NewMap("stage_runs")
+	stageFailures = expvar.NewMap("stage_failures")
+	stageDuration = expvar.NewMap("stage_duration_ms")
+)
+
+// loggingMiddleware logs the start, end and duration of every stage
+func loggingMiddleware(next StageFunc) StageFunc {
+	return func(pc *PipelineContext) error {
+		pc.Logger.Debug("Running stage", "attempt", pc.Job.Attempts+1)
+
+		start := time.Now()
+		err := next(pc)
+		if errors.Is(err, errWaitForUser) {
+			pc.Logger.Info("Stage waiting for user", "duration", time.Since(start))
+			return err
+		}
+		if errors.Is(err, errJobFinished) {
+			pc.Logger.Info("Stage finished the job", "duration", time.Since(start))
+			return err
+		}
+		if err != nil {
+			pc.Logger.Warn("Stage failed", "duration", time.Since(start), "error", err)
+			return err
+		}
+
+		pc.Logger.Info("Stage finished", "duration", time.Since(start))
+		return nil
+	}
+}
+
+// metricsMiddleware counts runs, failures and time spent per stage, exposed on /debug/vars with the API token
+func metricsMiddleware(next StageFunc) StageFunc {
+	return func(pc *PipelineContext) error {
+		start := time.Now()
+		err := next(pc)
+
+		stageRuns.Add(pc.Stage, 1)
+		stageDuration.Add(pc.Stage, time.Since(start).Milliseconds())
+		if err != nil && !errors.Is(err, errWaitForUser) && !errors.Is(err, errJobFinished) {
+			stageFailures.Add(pc.Stage, 1)
+		}
+
+		return err
+	}
+}
+
+// recoverMiddleware turns panics in a stage into errors so the job is retried instead of crashing the daemon
+func recoverMiddleware(next StageFunc) StageFunc {
+	return func(pc *PipelineContext) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				pc.Logger.Error("Stage panicked", "panic", r)
+				err = fmt.Errorf("stage %s panicked: %v", pc.Stage, r)
+			}
+		}()
+
+		return next(pc)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// Prompts are named templates, the name carries the version, e.g. classify-v2. The built-in
+// prompts are embedded, "prompts.dir" adds prompts or replaces built-in ones with the same name.
+// Templates are rendered with the profile of the user, see userProfile.
+//
+//go:embed prompts/*.tmpl
+var builtinPrompts embed.FS
+
+const promptExt = ".tmpl"
+
+// defaultPromptName is the prompt used for classification, configured with "prompt" or per user
+// with "users.<user>.prompt". Without either, users with a profile get classify-v2 because
+// classify-v1 doesn't render profiles.
+func defaultPromptName(user string) string {
+	key := fmt.Sprintf("users.%s.prompt", user)
+	if user != "" && viper.IsSet(key) {
+		return viper.GetString(key)
+	}
+	if viper.IsSet("prompt") {
+		return viper.GetString("prompt")
+	}
+	if user != "" && viper.IsSet(fmt.Sprintf("users.%s.profile", user)) {
+		return "classify-v2"
+	}
+	return "classify-v1"
+}
+
+// userProfile holds personal facts that tell the LLM which documents are about the user:
+//
+//	users:
+//	  alice:
+//	    profile:
+//	      name: Alice Example
+//	      employers: [Biz Factory GmbH]
+//	      addresses: [Hildebrandtstraße 8]
+//	      banks: [Sparkasse, Comdirect]
+//	      insurers: [TK (Techniker Krankenkasse)]
+//	      schools: [TH Köln]
+//	      family: [Bob (husband)]
+//	      facts: [I own a car leased from ...]
+//	      categories:
+//	        tk: A document that is related to my health insurance at TK
+type userProfile struct {
+	Name      string
+	Employers []string
+	Addresses []string
+	Banks     []string
+	Insurers  []string
+	Schools   []string
+	Family    []string
+	Facts     []string
+	// Categories maps category names to descriptions, the keys are lower case
+	Categories map[string]string
+}
+
+// promptData is what prompt templates are rendered with, Profile is nil if the user has none
+type promptData struct {
+	User       string
+	Profile    *userProfile
+	Categories map[string]string
+}
+
+func profileOf(user string) (*userProfile, error) {
+	key := fmt.Sprintf("users.%s.profile", user)
+	if user == "" || !viper.IsSet(key) {
+		return nil, nil
+	}
+
+	var profile userProfile
+	err := viper.UnmarshalKey(key, &profile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid profile of user %s: %w", user, err)
+	}
+
+	return &profile, nil
+}
+
+// prompt is a rendered prompt template
+type prompt struct {
+	Name string
+	Text string
+}
+
+// Version identifies the prompt text, it changes whenever the template is edited
+func (p prompt) Version() string {
+	sum := sha256.Sum256([]byte(p.Text))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// ID is recorded on jobs, it names the prompt and the version of its text
+func (p prompt) ID() string {
+	return p.Name + "@" + p.Version()
+}
+
+// promptSource returns the template of a prompt, the prompts directory takes precedence over the built-in prompts
+func promptSource(name string) ([]byte, error) {
+	if dir := viper.GetString("prompts.dir"); dir != "" {
+		b, err := os.ReadFile(filepath.Join(dir, name+promptExt))
+		if err == nil {
+			return b, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	b, err := builtinPrompts.ReadFile("prompts/" + name + promptExt)
+	if err != nil {
+		return nil, fmt.Errorf("unknown prompt %q", name)
+	}
+	return b, nil
+}
+
+// loadPrompt renders a prompt for a user, the user's default prompt if name is empty. The user may
+// be empty if the document doesn't belong to anyone.
+func loadPrompt(name string, user string) (prompt, error) {
+	if name == "" {
+		name = defaultPromptName(user)
+	}
+
+	profile, err := profileOf(user)
+	if err != nil {
+		return prompt{}, err
+	}
+
+	data := promptData{User: user, Profile: profile}
+	if profile != nil {
+		data.Categories = profile.Categories
+	}
+
+	return renderPrompt(name, data)
+}
+
+// renderPrompt renders a prompt template with the given data
+func renderPrompt(name string, data promptData) (prompt, error) {
+	source, err := promptSource(name)
+	if err != nil {
+		return prompt{}, err
+	}
+
+	t, err := template.New(name).Parse(string(source))
+	if err != nil {
+		return prompt{}, fmt.Errorf("unable to parse prompt %s: %w", name, err)
+	}
+
+	var b bytes.Buffer
+	err = t.Execute(&b, data)
+	if err != nil {
+		return prompt{}, fmt.Errorf("unable to render prompt %s: %w", name, err)
+	}
+
+	return prompt{Name: name, Text: b.String()}, nil
+}
+
+// checkProfile fails if a user has a profile but the prompt renders the same without it
+func checkProfile(p prompt, user string) error {
+	profile, err := profileOf(user)
+	if err != nil || profile == nil {
+		return err
+	}
+
+	without, err := renderPrompt(p.Name, promptData{User: user})
+	if err != nil {
+		return err
+	}
+	if without.Text == p.Text {
+		return fmt.Errorf("prompt %s of user %s ignores the profile, use classify-v2 or a prompt that renders .Profile", p.Name, user)
+	}
+
+	return nil
+}
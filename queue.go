@@ -0,0 +1,231 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/storage"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// queue moves jobs through the pipeline with a bounded number of workers per pool
+type queue struct {
+	db       *sql.DB
+	pipeline *Pipeline
+
+	// jobCtx is passed to running jobs, it is only cancelled if they don't finish in time on shutdown
+	jobCtx     context.Context
+	cancelJobs context.CancelFunc
+	workers    sync.WaitGroup
+
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+// maxAttempts is how often a stage is tried before the job is dead-lettered. The classify stage
+// reads it too, so the default is not left to the queue.
+func maxAttempts() int {
+	viper.SetDefault("retry.max_attempts", 5)
+	return viper.GetInt("retry.max_attempts")
+}
+
+func newQueue(db *sql.DB, pipeline *Pipeline) *queue {
+	viper.SetDefault("retry.base_delay", 5*time.Second)
+	viper.SetDefault("retry.max_delay", 10*time.Minute)
+
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+
+	return &queue{
+		db:          db,
+		pipeline:    pipeline,
+		jobCtx:      jobCtx,
+		cancelJobs:  cancelJobs,
+		maxAttempts: maxAttempts(),
+		baseDelay:   viper.GetDuration("retry.base_delay"),
+		maxDelay:    viper.GetDuration("retry.max_delay"),
+	}
+}
+
+// start resumes interrupted jobs and starts the workers of every pool. Workers stop taking new
+// jobs when ctx is cancelled.
+func (q *queue) start(ctx context.Context) error {
+	n, err := storage.ResetRunningJobs(q.db)
+	if err != nil {
+		slog.Error("Error resetting running jobs", "error", err)
+		return err
+	}
+
+	depth, err := storage.QueueDepth(q.db)
+	if err != nil {
+		slog.Error("Error getting queue depth", "error", err)
+		return err
+	}
+
+	slog.Info("Starting job queue", "depth", depth, "resumed", n)
+
+	viper.SetDefault("workers.default", 1)
+	viper.SetDefault("workers.download", 1)
+	viper.SetDefault("workers.ocr", 1)
+	viper.SetDefault("workers.llm", 2)
+	viper.SetDefault("workers.upload", 2)
+
+	for pool, stages := range q.pipeline.Pools() {
+		size := max(viper.GetInt(fmt.Sprintf("workers.%s", pool)), 1)
+		slog.Debug("Starting worker pool", "pool", pool, "stages", stages, "size", size)
+
+		for i := 0; i < size; i++ {
+			q.workers.Add(1)
+			go q.work(ctx, pool, stages)
+		}
+	}
+
+	return nil
+}
+
+// shutdown waits for running jobs to finish and cancels them once the timeout is exceeded
+func (q *queue) shutdown(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	slog.Info("Waiting for running jobs to finish", "timeout", timeout)
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("Running jobs did not finish in time, cancelling them")
+		q.cancelJobs()
+		<-done
+	}
+
+	q.cancelJobs()
+	slog.Info("Job queue stopped")
+}
+
+func (q *queue) work(ctx context.Context, pool string, stages []string) {
+	defer q.workers.Done()
+
+	for ctx.Err() == nil {
+		job, err := storage.ClaimJob(q.db, stages)
+		if err != nil {
+			slog.Error("Error claiming job", "pool", pool, "error", err)
+		}
+
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		q.run(job)
+	}
+}
+
+// run executes the current stage of a job and either advances it or schedules a retry
+func (q *queue) run(job *storage.Job) {
+	stage, ok := q.pipeline.Stage(job.Stage)
+	if !ok {
+		slog.Error("Job is in a stage that is not part of the pipeline", "job", job.ID, "stage", job.Stage)
+		job.State = storage.JobDead
+		job.LastError = fmt.Sprintf("unknown stage %s", job.Stage)
+		q.save(job)
+		return
+	}
+
+	err := q.pipeline.Run(q.jobCtx, stage, job)
+	if errors.Is(err, errWaitForUser) {
+		// the stage runs again once the answer arrived
+		slog.Info("Job waiting for user", "job", job.ID, "stage", job.Stage)
+		job.State = storage.JobWaiting
+		q.save(job)
+		return
+	}
+	if errors.Is(err, errJobFinished) {
+		job.Stage = storage.StageDone
+		job.State = storage.JobDone
+		job.Attempts = 0
+		job.LastError = ""
+		q.save(job)
+		return
+	}
+	if errors.Is(err, errUnsupportedFile) {
+		// retrying doesn't change the file
+		slog.Error("Job rejected", "job", job.ID, "stage", job.Stage, "error", err)
+		job.State = storage.JobDead
+		job.LastError = err.Error()
+		q.save(job)
+
+		sendTelegramMessage(job.User, fmt.Sprintf("Can't process file <code>%s</code>, only PDF, JPEG, PNG, TIFF and HEIC files are supported", html.EscapeString(job.File)))
+		return
+	}
+	if err != nil && q.jobCtx.Err() != nil {
+		// aborted by shutdown, this doesn't count as an attempt and the job resumes after a restart
+		slog.Warn("Job cancelled by shutdown", "job", job.ID, "stage", job.Stage)
+		job.State = storage.JobPending
+		q.save(job)
+		return
+	}
+	if err != nil {
+		job.Attempts++
+		job.LastError = err.Error()
+
+		if job.Attempts >= q.maxAttempts {
+			slog.Error("Job failed permanently", "job", job.ID, "stage", job.Stage, "error", err)
+			job.State = storage.JobDead
+			q.save(job)
+
+			sendTelegramMessage(job.User, fmt.Sprintf("Giving up on file <code>%s</code> after %d tries in stage %s: <pre>%s</pre>", html.EscapeString(job.File), job.Attempts, job.Stage, html.EscapeString(err.Error())))
+			return
+		}
+
+		delay := q.backoff(job.Attempts)
+		slog.Warn("Job failed, retrying", "job", job.ID, "stage", job.Stage, "attempt", job.Attempts, "delay", delay)
+
+		job.State = storage.JobPending
+		job.NextAttemptAt = time.Now().Add(delay)
+		q.save(job)
+		return
+	}
+
+	// every stage gets its own attempts
+	job.Stage = q.pipeline.Next(job.Stage)
+	job.Attempts = 0
+	job.LastError = ""
+	job.State = storage.JobPending
+	if job.Stage == storage.StageDone {
+		job.State = storage.JobDone
+	}
+
+	q.save(job)
+}
+
+func (q *queue) save(job *storage.Job) {
+	err := storage.UpdateJob(q.db, *job)
+	if err != nil {
+		slog.Error("Error saving job", "job", job.ID, "error", err)
+	}
+}
+
+// backoff returns an exponential delay with jitter for the given attempt
+func (q *queue) backoff(attempt int) time.Duration {
+	delay := q.baseDelay
+	for i := 1; i < attempt && delay < q.maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, q.maxDelay)
+
+	// full jitter between half and the whole delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	rateLimitWaits = expvar.NewMap("rate_limit_waits")
+	rateLimited    = expvar.NewMap("rate_limited")
+)
+
+// rateLimiter is a token bucket shared by all calls to an external API. Callers that find the
+// bucket empty queue up instead of failing.
+type rateLimiter struct {
+	name string
+
+	mu     sync.Mutex
+	rate   float64 // tokens per second, zero or less means unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+	// blockedUntil is set from Retry-After headers, no requests are made before it
+	blockedUntil time.Time
+}
+
+func newRateLimiter(name string, perMinute float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		name:   name,
+		rate:   perMinute / 60,
+		burst:  float64(max(burst, 1)),
+		tokens: float64(max(burst, 1)),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long to wait before it may be used. The bucket goes
+// negative for queued callers, so they are served in order.
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.rate <= 0 {
+		return max(0, l.blockedUntil.Sub(now))
+	}
+
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+
+	return max(wait, l.blockedUntil.Sub(now))
+}
+
+// Wait blocks until the request may be made or it is cancelled
+func (l *rateLimiter) Wait(req *http.Request) error {
+	wait := l.reserve()
+	if wait <= 0 {
+		return nil
+	}
+
+	rateLimitWaits.Add(l.name, 1)
+	slog.Debug("Waiting for rate limit", "api", l.name, "wait", wait)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		// give the token back to the callers behind us
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return req.Context().Err()
+	}
+}
+
+// Block stops all requests for d, e.g. after a 429 with Retry-After
+func (l *rateLimiter) Block(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(l.blockedUntil) {
+		l.blockedUntil = until
+	}
+}
+
+var (
+	rateLimitersMu sync.Mutex
+	rateLimiters   = make(map[string]*rateLimiter)
+)
+
+// apiLimiter returns the shared rate limiter of an API, configured with "rate_limits.<api>.per_minute" and "rate_limits.<api>.burst".
+// A per_minute of 0 disables the limit, Retry-After headers are still respected.
+func apiLimiter(api string) *rateLimiter {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+
+	if l, ok := rateLimiters[api]; ok {
+		return l
+	}
+
+	viper.SetDefault("rate_limits.openai.per_minute", 60)
+	viper.SetDefault("rate_limits.openai.burst", 5)
+	// Telegram allows about one message per second and 20 per minute in the same chat
+	viper.SetDefault("rate_limits.telegram.per_minute", 20)
+	viper.SetDefault("rate_limits.telegram.burst", 5)
+
+	l := newRateLimiter(api,
+		viper.GetFloat64(fmt.Sprintf("rate_limits.%s.per_minute", api)),
+		viper.GetInt(fmt.Sprintf("rate_limits.%s.burst", api)))
+	rateLimiters[api] = l
+	return l
+}
+
+// rateLimitedTransport waits for the rate limiter before every request and retries requests that
+// were answered with 429 Too Many Requests once the server allows it again
+type rateLimitedTransport struct {
+	limiter    *rateLimiter
+	base       http.RoundTripper
+	maxRetries int
+}
+
+// rateLimitedClient returns an HTTP client that shares the rate limit of an API
+func rateLimitedClient(api string) *http.Client {
+	viper.SetDefault("rate_limits.max_retries", 5)
+
+	return &http.Client{
+		Transport: &rateLimitedTransport{
+			limiter:    apiLimiter(api),
+			base:       http.DefaultTransport,
+			maxRetries: viper.GetInt("rate_limits.max_retries"),
+		},
+	}
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		err := t.limiter.Wait(req)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+
+		rateLimited.Add(t.limiter.name, 1)
+
+		// the body can't be sent again
+		if attempt >= t.maxRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+
+		delay := retryAfter(resp, attempt)
+		resp.Body.Close()
+
+		slog.Warn("Rate limited, retrying", "api", t.limiter.name, "retry_after", delay, "attempt", attempt+1)
+		t.limiter.Block(delay)
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// retryAfter returns how long to wait after a 429. It understands the Retry-After header,
+// OpenAI's x-ratelimit-reset-requests header and Telegram's retry_after parameter.
+func retryAfter(resp *http.Response, attempt int) time.Duration {
+	if header := resp.Header.Get("Retry-After"); header != "" {
+		if seconds, err := strconv.Atoi(header); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(header); err == nil {
+			return time.Until(date)
+		}
+	}
+
+	if header := resp.Header.Get("X-Ratelimit-Reset-Requests"); header != "" {
+		if d, err := time.ParseDuration(header); err == nil {
+			return d
+		}
+	}
+
+	var telegram struct {
+		Parameters struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(body, &telegram) == nil && telegram.Parameters.RetryAfter > 0 {
+		return time.Duration(telegram.Parameters.RetryAfter) * time.Second
+	}
+
+	// exponential fallback if the server doesn't say
+	return time.Second << attempt
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// about compares durations that depend on the clock
+func about(got time.Duration, want time.Duration) bool {
+	return got >= want-50*time.Millisecond && got <= want+50*time.Millisecond
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	tests := []struct {
+		name      string
+		perMinute float64
+		burst     int
+		// idle is how long an empty bucket refilled before the reservations, a full one is used otherwise
+		idle    time.Duration
+		blocked time.Duration
+		want    []time.Duration
+	}{
+		{name: "burst", perMinute: 60, burst: 3, want: []time.Duration{0, 0, 0, time.Second, 2 * time.Second}},
+		{name: "queue", perMinute: 120, burst: 1, want: []time.Duration{0, 500 * time.Millisecond, time.Second}},
+		{name: "refilled", perMinute: 60, burst: 2, idle: 2 * time.Second, want: []time.Duration{0, 0, time.Second}},
+		{name: "no more than burst", perMinute: 60, burst: 1, idle: time.Minute, want: []time.Duration{0, time.Second}},
+		{name: "unlimited", perMinute: 0, burst: 1, want: []time.Duration{0, 0, 0}},
+		{name: "blocked", perMinute: 60, burst: 2, blocked: 5 * time.Second, want: []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second}},
+		{name: "unlimited blocked", perMinute: 0, burst: 1, blocked: 5 * time.Second, want: []time.Duration{5 * time.Second}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newRateLimiter("test", test.perMinute, test.burst)
+			if test.idle > 0 {
+				l.tokens = 0
+			}
+			l.last = time.Now().Add(-test.idle)
+			l.Block(test.blocked)
+
+			for i, want := range test.want {
+				if got := l.reserve(); !about(got, want) {
+					t.Errorf("reservation %d waits %s, want %s", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		body    string
+		attempt int
+		want    time.Duration
+	}{
+		{name: "seconds", header: http.Header{"Retry-After": {"7"}}, want: 7 * time.Second},
+		{name: "HTTP date", header: http.Header{"Retry-After": {time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)}}, want: 10 * time.Second},
+		{name: "OpenAI reset", header: http.Header{"X-Ratelimit-Reset-Requests": {"1m30s"}}, want: 90 * time.Second},
+		{name: "Retry-After wins", header: http.Header{"Retry-After": {"2"}, "X-Ratelimit-Reset-Requests": {"1m30s"}}, want: 2 * time.Second},
+		{name: "invalid header", header: http.Header{"Retry-After": {"soon"}}, attempt: 1, want: 2 * time.Second},
+		{name: "Telegram", body: `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 14","parameters":{"retry_after":14}}`, want: 14 * time.Second},
+		{name: "fallback", body: "slow down", attempt: 3, want: 8 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Header:     test.header,
+				Body:       io.NopCloser(strings.NewReader(test.body)),
+			}
+			if resp.Header == nil {
+				resp.Header = http.Header{}
+			}
+
+			got := retryAfter(resp, test.attempt)
+			// HTTP dates only have seconds
+			if got < test.want-time.Second || got > test.want {
+				t.Errorf("retryAfter = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitedTransportRetries(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "request" {
+			t.Errorf("body of request %d = %q", requests.Load()+1, body)
+		}
+
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &rateLimitedTransport{
+		limiter:    newRateLimiter("test", 0, 1),
+		base:       http.DefaultTransport,
+		maxRetries: 1,
+	}}
+
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || requests.Load() != 2 {
+		t.Errorf("status %s after %d requests, want 200 OK after 2", resp.Status, requests.Load())
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/storage"
+	"database/sql"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+)
+
+// Routing files documents for the household member they are addressed to, whoever scanned them.
+// Users are recognized by their profile name, aliases and addresses:
+//
+//	routing:
+//	  enabled: true
+//	users:
+//	  bob:
+//	    aliases: [Bob Example, B. Example]
+//	    profile:
+//	      name: Robert Example
+//	      addresses: [Musterweg 1]
+func routingEnabled() bool {
+	return viper.GetBool("routing.enabled")
+}
+
+func normalizeName(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// containsName reports whether text contains name as whole words, both are normalized
+func containsName(text string, name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for offset := 0; ; {
+		i := strings.Index(text[offset:], name)
+		if i < 0 {
+			return false
+		}
+		start := offset + i
+		end := start + len(name)
+
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if (start == 0 || !unicode.IsLetter(before)) && (end == len(text) || !unicode.IsLetter(after)) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+// recipientNames returns the names and addresses that identify a user on a letter
+func recipientNames(user string) ([]string, []string, error) {
+	names := viper.GetStringSlice(fmt.Sprintf("users.%s.aliases", user))
+
+	profile, err := profileOf(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var addresses []string
+	if profile != nil {
+		if profile.Name != "" {
+			names = append(names, profile.Name)
+		}
+		addresses = profile.Addresses
+	}
+
+	return names, addresses, nil
+}
+
+// containsWords reports whether text contains every word of name, so "Alice und Bob Example"
+// matches both "Alice Example" and "Bob Example"
+func containsWords(text string, name string) bool {
+	words := strings.Fields(name)
+	if len(words) == 0 {
+		return false
+	}
+
+	for _, word := range words {
+		if !containsName(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRecipients returns the users a text is addressed to. Names are preferred, addresses only
+// count if they belong to a single user, as members of a household usually share one. Names may
+// be split up in short texts like the recipient found by the LLM.
+func matchRecipients(text string, short bool) ([]string, error) {
+	text = normalizeName(text)
+
+	matchName := containsName
+	if short {
+		matchName = containsWords
+	}
+
+	var users []string
+	for user := range viper.GetStringMap("users") {
+		users = append(users, user)
+	}
+	slices.Sort(users)
+
+	var byName, byAddress []string
+	for _, user := range users {
+		names, addresses, err := recipientNames(user)
+		if err != nil {
+			return nil, err
+		}
+
+		if slices.ContainsFunc(names, func(name string) bool { return matchName(text, normalizeName(name)) }) {
+			byName = append(byName, user)
+		}
+		if slices.ContainsFunc(addresses, func(address string) bool { return containsName(text, normalizeName(address)) }) {
+			byAddress = append(byAddress, user)
+		}
+	}
+
+	if len(byName) > 0 {
+		return byName, nil
+	}
+	if len(byAddress) == 1 {
+		return byAddress, nil
+	}
+	return nil, nil
+}
+
+// recipientText returns the addressee found by the LLM, or the start of the document where the
+// address usually is. It reports whether the text is only the addressee.
+func recipientText(job *storage.Job) (string, bool) {
+	if job.Classification.Recipient != "" {
+		return job.Classification.Recipient, true
+	}
+
+	viper.SetDefault("routing.window", 500)
+	window := min(viper.GetInt("routing.window"), len(job.OCR))
+	return strings.ToValidUTF8(job.OCR[:window], ""), false
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// routeJob adds a copy of the job for another user. The copy starts again at the rules, so it is
+// classified with the recipient's rules, prompt and categories and filed at their destinations.
+// It gets its own spooled file since every job removes its file when it is done.
+func routeJob(db *sql.DB, pc *PipelineContext, user string) error {
+	job := *pc.Job
+
+	localFile := filepath.Join(filepath.Dir(job.LocalFile), fmt.Sprintf("%d-%s.pdf", job.ID, user))
+	err := copyFile(job.LocalFile, localFile)
+	if err != nil {
+		return fmt.Errorf("unable to copy spooled file: %w", err)
+	}
+
+	job.User = user
+	// the uploader's folder is part of the name, so it can't clash with the files in the recipient's FTP folder
+	job.File = pc.Job.User + "/" + pc.Job.File
+	job.LocalFile = localFile
+	job.Confirmed = false
+	job.Classification = storage.Classification{}
+	job.Model = ""
+	job.PromptVersion = ""
+	job.Variant = ""
+
+	job.Artifacts = maps.Clone(pc.Job.Artifacts)
+	// everything the uploader's rules and classification decided is redone for the recipient
+	for _, key := range []string{"rules", "classifier", "shadow", "routed_to", "rerouted"} {
+		delete(job.Artifacts, key)
+	}
+	job.Artifacts["routed_from"] = pc.Job.User
+
+	id, err := storage.CloneJob(db, job, "rules")
+	if err != nil {
+		os.Remove(localFile)
+		return err
+	}
+
+	pc.Logger.Info("Routed document", "recipient", user, "job", id)
+	return nil
+}
+
+// routeStage files a document for the users it is addressed to. The uploader keeps the document
+// if it is addressed to them too, e.g. for joint accounts.
+func routeStage(db *sql.DB, pc *PipelineContext) error {
+	// routed copies were addressed to their user already, routing them again could send them back
+	if !routingEnabled() || pc.Artifact("duplicate_action") == duplicateSkip || pc.Artifact("routed_from") != "" {
+		return nil
+	}
+
+	recipients, err := matchRecipients(recipientText(pc.Job))
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		pc.Logger.Debug("No known recipient")
+		return nil
+	}
+
+	// users are added one by one, so a retry doesn't route twice
+	var routed []string
+	if pc.Artifact("routed_to") != "" {
+		routed = strings.Split(pc.Artifact("routed_to"), ",")
+	}
+
+	for _, user := range recipients {
+		if user == pc.Job.User || slices.Contains(routed, user) {
+			continue
+		}
+
+		err := routeJob(db, pc, user)
+		if err != nil {
+			return err
+		}
+
+		routed = append(routed, user)
+		pc.SetArtifact("routed_to", strings.Join(routed, ","))
+
+		// the job is only saved after the stage, a crash in between must not route it again
+		err = storage.UpdateJob(db, *pc.Job)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(routed) > 0 && !slices.Contains(recipients, pc.Job.User) {
+		pc.SetArtifact("rerouted", "true")
+	}
+
+	return nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/storage"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// rule classifies documents deterministically. Rules are configured globally in "rules" and per
+// user in "users.<user>.rules", user rules are evaluated first:
+//
+//	rules:
+//	  - name: tk
+//	    match:
+//	      text: "(?i)techniker\\s+krankenkasse"
+//	    category: tk
+//	    skip_llm: true
+//	  - name: sparkasse-iban
+//	    match:
+//	      keywords: ["DE12 3005 0110"]
+//	    hint: "The document is probably related to my account at Sparkasse"
+//
+// All conditions of a rule must match. The first matching rule that sets a field wins, tags and
+// hints of all matching rules are combined.
+type rule struct {
+	Name  string `mapstructure:"name"`
+	Match struct {
+		// Text is a regular expression on the OCR text, named groups are available in the title template
+		Text string `mapstructure:"text"`
+		// Keywords must all appear in the OCR text, case is ignored
+		Keywords []string `mapstructure:"keywords"`
+		// Sender is a regular expression on the sender the LLM read from the document. Rules with a
+		// sender are only evaluated after the LLM, so they can't skip it or add hints.
+		Sender string `mapstructure:"sender"`
+		// Folder is a regular expression on the source folder of the scan
+		Folder string `mapstructure:"folder"`
+		// Filename is a regular expression on the original file name
+		Filename string `mapstructure:"filename"`
+	} `mapstructure:"match"`
+
+	Category string   `mapstructure:"category"`
+	Tags     []string `mapstructure:"tags"`
+	// Title is a template, e.g. "TK {{.Year}}-{{.Month}}" or "Rechnung {{.Groups.number}}"
+	Title string `mapstructure:"title"`
+	// Destination is a path template that replaces all configured path templates
+	Destination string `mapstructure:"destination"`
+	// SkipLLM uses the category of the rule without asking the LLM
+	SkipLLM bool `mapstructure:"skip_llm"`
+	// Hint is added to the prompt
+	Hint string `mapstructure:"hint"`
+
+	text, sender, folder, filename *regexp.Regexp
+}
+
+// ruleResult is the combined outcome of all matching rules, it is stored with the job
+type ruleResult struct {
+	Rules       []string          `json:"rules"`
+	Category    string            `json:"category,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Title       string            `json:"title,omitempty"`
+	Destination string            `json:"destination,omitempty"`
+	SkipLLM     bool              `json:"skip_llm,omitempty"`
+	Hints       []string          `json:"hints,omitempty"`
+	Groups      map[string]string `json:"groups,omitempty"`
+}
+
+// titleData is passed to title templates
+type titleData struct {
+	storage.Classification
+	User   string
+	File   string
+	Groups map[string]string
+	Year   string
+	Month  string
+	Day    string
+}
+
+func compileRule(r *rule) error {
+	if r.Name == "" {
+		return fmt.Errorf("rule without name")
+	}
+	if r.SkipLLM && r.Category == "" {
+		return fmt.Errorf("rule %s skips the LLM without setting a category", r.Name)
+	}
+	if r.Match.Sender != "" && (r.SkipLLM || r.Hint != "") {
+		return fmt.Errorf("rule %s matches the sender, which is only known after the LLM, so it can't skip the LLM or add a hint", r.Name)
+	}
+
+	for _, field := range []struct {
+		pattern string
+		re      **regexp.Regexp
+	}{
+		{r.Match.Text, &r.text},
+		{r.Match.Sender, &r.sender},
+		{r.Match.Folder, &r.folder},
+		{r.Match.Filename, &r.filename},
+	} {
+		if field.pattern == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(field.pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern in rule %s: %w", r.Name, err)
+		}
+		*field.re = re
+	}
+
+	if r.Title != "" {
+		_, err := template.New("title").Parse(r.Title)
+		if err != nil {
+			return fmt.Errorf("invalid title template in rule %s: %w", r.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// userRules returns the rules of a user followed by the global rules
+func userRules(user string) ([]rule, error) {
+	var rules []rule
+	for _, key := range []string{fmt.Sprintf("users.%s.rules", user), "rules"} {
+		var configured []rule
+		err := viper.UnmarshalKey(key, &configured)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		rules = append(rules, configured...)
+	}
+
+	for i := range rules {
+		err := compileRule(&rules[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+// validateRules checks the rules of all users so configuration errors show up on startup
+func validateRules() error {
+	_, err := userRules("")
+	if err != nil {
+		return err
+	}
+
+	for user := range viper.GetStringMap("users") {
+		_, err := userRules(user)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matches reports whether a rule matches a job and returns the named groups of the text pattern
+func (r *rule) matches(job *storage.Job, sender string) (map[string]string, bool) {
+	if r.folder != nil && !r.folder.MatchString(job.User) {
+		return nil, false
+	}
+	if r.filename != nil && !r.filename.MatchString(job.File) {
+		return nil, false
+	}
+	if r.sender != nil && (sender == "" || !r.sender.MatchString(sender)) {
+		return nil, false
+	}
+
+	text := strings.ToLower(job.OCR)
+	for _, keyword := range r.Match.Keywords {
+		if !strings.Contains(text, strings.ToLower(keyword)) {
+			return nil, false
+		}
+	}
+
+	groups := make(map[string]string)
+	if r.text != nil {
+		match := r.text.FindStringSubmatch(job.OCR)
+		if match == nil {
+			return nil, false
+		}
+		for i, name := range r.text.SubexpNames() {
+			if name != "" {
+				groups[name] = strings.TrimSpace(match[i])
+			}
+		}
+	}
+
+	return groups, true
+}
+
+// evaluateRules combines all rules of a user that match a job, sender is empty before classification
+func evaluateRules(job *storage.Job, sender string) (ruleResult, error) {
+	rules, err := userRules(job.User)
+	if err != nil {
+		return ruleResult{}, err
+	}
+
+	result := ruleResult{Groups: make(map[string]string)}
+	for i := range rules {
+		r := &rules[i]
+
+		groups, ok := r.matches(job, sender)
+		if !ok {
+			continue
+		}
+
+		result.Rules = append(result.Rules, r.Name)
+		for name, value := range groups {
+			if _, ok := result.Groups[name]; !ok {
+				result.Groups[name] = value
+			}
+		}
+
+		if result.Category == "" && r.Category != "" {
+			result.Category = r.Category
+			result.SkipLLM = r.SkipLLM
+		}
+		if result.Title == "" {
+			result.Title = r.Title
+		}
+		if result.Destination == "" {
+			result.Destination = r.Destination
+		}
+		result.Tags = append(result.Tags, r.Tags...)
+		if r.Hint != "" {
+			result.Hints = append(result.Hints, r.Hint)
+		}
+	}
+
+	return result, nil
+}
+
+// rulesStage evaluates the rules before the LLM, later stages apply the result
+func rulesStage(pc *PipelineContext) error {
+	result, err := evaluateRules(pc.Job, "")
+	if err != nil {
+		return err
+	}
+
+	if len(result.Rules) == 0 {
+		return nil
+	}
+
+	pc.Logger.Info("Rules matched", "rules", result.Rules, "category", result.Category, "skip_llm", result.SkipLLM)
+	return saveRuleResult(pc, result)
+}
+
+// senderRules evaluates the rules again once the LLM read the sender of the document, so rules
+// matching the sender apply too
+func senderRules(pc *PipelineContext, sender string) (ruleResult, error) {
+	result, err := evaluateRules(pc.Job, sender)
+	if err != nil || len(result.Rules) == 0 {
+		return result, err
+	}
+
+	pc.Logger.Info("Rules matched after classification", "rules", result.Rules, "sender", sender)
+	return result, saveRuleResult(pc, result)
+}
+
+// saveRuleResult stores the result of the rules for later stages
+func saveRuleResult(pc *PipelineContext, result ruleResult) error {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	pc.SetArtifact("rules", string(b))
+	return nil
+}
+
+// ruleResultOf returns the result of the rules stage of a job
+func ruleResultOf(pc *PipelineContext) (ruleResult, error) {
+	var result ruleResult
+
+	artifact := pc.Artifact("rules")
+	if artifact == "" {
+		return result, nil
+	}
+
+	err := json.Unmarshal([]byte(artifact), &result)
+	if err != nil {
+		return result, fmt.Errorf("invalid rules artifact: %w", err)
+	}
+
+	return result, nil
+}
+
+// apply overrides a classification with the result of the rules and records the rules in the explanation
+func (r ruleResult) apply(job *storage.Job, classification storage.Classification) (storage.Classification, error) {
+	if len(r.Rules) == 0 {
+		return classification, nil
+	}
+
+	if r.Category != "" {
+		classification.Category = r.Category
+	}
+	classification.Tags = append(classification.Tags, r.Tags...)
+
+	if r.Title != "" {
+		date, err := time.Parse("2006-01-02", classification.Date)
+		if err != nil {
+			date = time.Now()
+		}
+
+		tmpl, err := template.New("title").Parse(r.Title)
+		if err != nil {
+			return classification, fmt.Errorf("invalid title template: %w", err)
+		}
+
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, titleData{
+			Classification: classification,
+			User:           job.User,
+			File:           job.File,
+			Groups:         r.Groups,
+			Year:           date.Format("2006"),
+			Month:          date.Format("01"),
+			Day:            date.Format("02"),
+		})
+		if err != nil {
+			return classification, fmt.Errorf("unable to render title template: %w", err)
+		}
+		classification.Title = buf.String()
+	}
+
+	audit := fmt.Sprintf("Matched rules: %s.", strings.Join(r.Rules, ", "))
+	if r.SkipLLM {
+		audit = fmt.Sprintf("Classified as %s by rules: %s.", r.Category, strings.Join(r.Rules, ", "))
+	}
+	if classification.Explanation != "" && !r.SkipLLM {
+		audit = classification.Explanation + " " + audit
+	}
+	classification.Explanation = audit
+
+	return classification, nil
+}
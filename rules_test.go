@@ -0,0 +1,194 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"3nt3/ai-scan-classifier/storage"
+
+	"github.com/spf13/viper"
+)
+
+// setRules configures global and alice's rules for the duration of a test
+func setRules(t *testing.T, global []map[string]any, alice []map[string]any) {
+	t.Helper()
+	t.Cleanup(viper.Reset)
+
+	viper.Set("rules", global)
+	viper.Set("users.alice.rules", alice)
+}
+
+func TestCompileRule(t *testing.T) {
+	tests := []struct {
+		name string
+		rule rule
+		err  string
+	}{
+		{name: "valid", rule: rule{Name: "tk", Category: "tk", SkipLLM: true}},
+		{name: "no name", rule: rule{Category: "tk"}, err: "rule without name"},
+		{name: "skip without category", rule: rule{Name: "tk", SkipLLM: true}, err: "skips the LLM without setting a category"},
+		{name: "sender skips", rule: func() rule {
+			r := rule{Name: "tk", Category: "tk", SkipLLM: true}
+			r.Match.Sender = "TK"
+			return r
+		}(), err: "only known after the LLM"},
+		{name: "invalid pattern", rule: func() rule {
+			r := rule{Name: "tk"}
+			r.Match.Text = "("
+			return r
+		}(), err: "invalid pattern in rule tk"},
+		{name: "invalid title", rule: rule{Name: "tk", Title: "{{.Year"}, err: "invalid title template in rule tk"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := compileRule(&test.rule)
+			if test.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	job := &storage.Job{User: "alice", File: "scan_0042.pdf", OCR: "Techniker Krankenkasse\nRechnung Nr. 2024-17\nIBAN DE12 3005 0110"}
+
+	tests := []struct {
+		name   string
+		match  map[string]any
+		sender string
+		ok     bool
+		groups map[string]string
+	}{
+		{name: "text", match: map[string]any{"text": `(?i)techniker\s+krankenkasse`}, ok: true},
+		{name: "text mismatch", match: map[string]any{"text": `AOK`}},
+		{name: "groups", match: map[string]any{"text": `Rechnung Nr\. (?P<number>[\d-]+)`}, ok: true, groups: map[string]string{"number": "2024-17"}},
+		{name: "keywords ignore case", match: map[string]any{"keywords": []string{"techniker", "de12 3005"}}, ok: true},
+		{name: "all keywords", match: map[string]any{"keywords": []string{"techniker", "barmer"}}},
+		{name: "folder", match: map[string]any{"folder": "^alice$"}, ok: true},
+		{name: "other folder", match: map[string]any{"folder": "^bob$"}},
+		{name: "filename", match: map[string]any{"filename": `^scan_\d+\.pdf$`}, ok: true},
+		{name: "sender", match: map[string]any{"sender": "(?i)^tk"}, sender: "TK Hamburg", ok: true},
+		{name: "sender before the LLM", match: map[string]any{"sender": "(?i)^tk"}},
+		{name: "all conditions", match: map[string]any{"text": "Techniker", "folder": "^bob$"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setRules(t, []map[string]any{{"name": test.name, "match": test.match}}, nil)
+
+			rules, err := userRules("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			groups, ok := rules[0].matches(job, test.sender)
+			if ok != test.ok {
+				t.Fatalf("matches = %v, want %v", ok, test.ok)
+			}
+			for name, want := range test.groups {
+				if groups[name] != want {
+					t.Errorf("group %s = %q, want %q", name, groups[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateRules(t *testing.T) {
+	setRules(t,
+		[]map[string]any{
+			{"name": "insurance", "match": map[string]any{"keywords": []string{"krankenkasse"}}, "category": "insurance", "tags": []string{"global"}, "hint": "It is about insurance"},
+			{"name": "tk-sender", "match": map[string]any{"sender": "TK"}, "category": "tk-sender"},
+		},
+		[]map[string]any{
+			{"name": "tk", "match": map[string]any{"text": "Techniker"}, "category": "tk", "skip_llm": true, "title": "TK {{.Year}}", "tags": []string{"health"}},
+			{"name": "other", "match": map[string]any{"text": "Techniker"}, "category": "other", "title": "Other", "hint": "It is from TK"},
+		},
+	)
+
+	job := &storage.Job{User: "alice", File: "scan.pdf", OCR: "Techniker Krankenkasse"}
+
+	result, err := evaluateRules(job, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// user rules come first and the first rule that sets a field wins
+	if !slices.Equal(result.Rules, []string{"tk", "other", "insurance"}) {
+		t.Errorf("rules = %q", result.Rules)
+	}
+	if result.Category != "tk" || !result.SkipLLM || result.Title != "TK {{.Year}}" {
+		t.Errorf("result = %+v", result)
+	}
+	// tags and hints of all rules are combined
+	if !slices.Equal(result.Tags, []string{"health", "global"}) {
+		t.Errorf("tags = %q", result.Tags)
+	}
+	if !slices.Equal(result.Hints, []string{"It is from TK", "It is about insurance"}) {
+		t.Errorf("hints = %q", result.Hints)
+	}
+
+	// sender rules only match once the LLM read the sender
+	result, err = evaluateRules(job, "TK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(result.Rules, "tk-sender") {
+		t.Errorf("rules with sender = %q", result.Rules)
+	}
+}
+
+func TestRuleResultApply(t *testing.T) {
+	job := &storage.Job{User: "alice", File: "scan.pdf"}
+	llm := storage.Classification{Title: "Beitragsrechnung", Category: "misc", Date: "2024-05-02", Explanation: "A letter from TK.", Tags: []string{"letter"}}
+
+	tests := []struct {
+		name   string
+		result ruleResult
+		want   storage.Classification
+	}{
+		{
+			name:   "no rules",
+			result: ruleResult{},
+			want:   llm,
+		},
+		{
+			name:   "after the LLM",
+			result: ruleResult{Rules: []string{"tk", "health"}, Category: "tk", Tags: []string{"health"}},
+			want: storage.Classification{Title: "Beitragsrechnung", Category: "tk", Date: "2024-05-02", Tags: []string{"letter", "health"},
+				Explanation: "A letter from TK. Matched rules: tk, health."},
+		},
+		{
+			name:   "skipped LLM",
+			result: ruleResult{Rules: []string{"tk"}, Category: "tk", SkipLLM: true},
+			want: storage.Classification{Title: "Beitragsrechnung", Category: "tk", Date: "2024-05-02", Tags: []string{"letter"},
+				Explanation: "Classified as tk by rules: tk."},
+		},
+		{
+			name:   "title",
+			result: ruleResult{Rules: []string{"invoice"}, Title: "{{.User}} {{.Year}}-{{.Month}} {{.Groups.number}}", Groups: map[string]string{"number": "17"}},
+			want: storage.Classification{Title: "alice 2024-05 17", Category: "misc", Date: "2024-05-02", Tags: []string{"letter"},
+				Explanation: "A letter from TK. Matched rules: invoice."},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			classification := llm
+			classification.Tags = slices.Clone(llm.Tags)
+
+			got, err := test.result.apply(job, classification)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Title != test.want.Title || got.Category != test.want.Category || got.Explanation != test.want.Explanation || !slices.Equal(got.Tags, test.want.Tags) {
+				t.Errorf("apply = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
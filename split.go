@@ -0,0 +1,374 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/storage"
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+)
+
+// Splitting turns a stack of letters that went through the feeder in one go into one job per
+// letter. Boundaries are found with any of these methods:
+//
+//	split:
+//	  methods: [separator, blank, llm]
+//	  # separator sheets carry this text or a QR code with this content, QR codes need zbarimg
+//	  separator_text: SEPARATOR SHEET
+//	  separator_code: PATCHT
+//	  # pages with less ink coverage and almost no text are blank
+//	  blank_threshold: 0.01
+//	  # the model that decides where documents start
+//	  model: gpt-4
+const (
+	splitSeparator = "separator"
+	splitBlank     = "blank"
+	splitLLM       = "llm"
+)
+
+// errJobFinished is returned by stages after which the job needs no further stages
+var errJobFinished = errors.New("job finished early")
+
+func splitMethods() []string {
+	return viper.GetStringSlice("split.methods")
+}
+
+// pageTexts splits the OCR text into pages, ocrmypdf separates them with form feeds
+func pageTexts(ocr string) []string {
+	return strings.Split(strings.TrimSuffix(ocr, "\f"), "\f")
+}
+
+// inkCoverage returns the average CMYK ink coverage of every page
+func inkCoverage(ctx context.Context, file string) ([]float64, error) {
+	i, err := runLocal(interactionCoverage, file, "", func(i *interaction) error {
+		var err error
+		i.Coverage, err = measureInk(ctx, file)
+		return err
+	})
+	return i.Coverage, err
+}
+
+func measureInk(ctx context.Context, file string) ([]float64, error) {
+	output, err := exec.CommandContext(ctx, "gs", "-q", "-o", "-", "-sDEVICE=inkcov", file).Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to measure ink coverage: %w", err)
+	}
+
+	var coverage []float64
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[4] != "CMYK" {
+			continue
+		}
+
+		var sum float64
+		for _, field := range fields[:4] {
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected ink coverage output %q", scanner.Text())
+			}
+			sum += v
+		}
+		coverage = append(coverage, sum/4)
+	}
+
+	return coverage, scanner.Err()
+}
+
+// separatorCodes returns the content of the QR codes on every page, it is empty if zbarimg is not installed
+func separatorCodes(ctx context.Context, file string, pages int) ([]string, error) {
+	if _, err := exec.LookPath("zbarimg"); err != nil {
+		return nil, nil
+	}
+
+	dir, err := os.MkdirTemp("", "ai-scan-classifier-split")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	output, err := exec.CommandContext(ctx, "gs", "-q", "-o", filepath.Join(dir, "page-%d.png"), "-sDEVICE=pnggray", "-r100", file).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("unable to render pages: %w: %s", err, output)
+	}
+
+	codes := make([]string, pages)
+	for i := range codes {
+		// zbarimg exits with 4 if there is no code on the page
+		output, _ := exec.CommandContext(ctx, "zbarimg", "-q", "--raw", filepath.Join(dir, fmt.Sprintf("page-%d.png", i+1))).Output()
+		codes[i] = strings.TrimSpace(string(output))
+	}
+
+	return codes, nil
+}
+
+// llmBoundaries asks the LLM which pages start a new document
+func llmBoundaries(ctx context.Context, model string, pages []string) ([]bool, openai.Usage, error) {
+	var b strings.Builder
+	b.WriteString(`The following texts are the OCR versions of consecutive scanned pages. They might belong to several documents, like letters from different senders that were scanned in one go. Give the numbers of the pages that start a new document in JSON format, e.g. {"starts": [1, 3]}. Page 1 always starts a document.`)
+	for i, page := range pages {
+		fmt.Fprintf(&b, "\n\nPage %d:\n%s", i+1, strings.ToValidUTF8(page[:min(400, len(page))], ""))
+	}
+
+	config := openai.DefaultConfig(os.Getenv("OPENAI_KEY"))
+	config.HTTPClient = rateLimitedClient("openai")
+
+	client := openai.NewClientWithConfig(config)
+	resp, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: model,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: b.String()},
+		},
+	})
+	if err != nil {
+		return nil, openai.Usage{}, err
+	}
+
+	var answer struct {
+		Starts []int `json:"starts"`
+	}
+	err = json.Unmarshal([]byte(resp.Choices[0].Message.Content), &answer)
+	if err != nil {
+		return nil, resp.Usage, fmt.Errorf("unable to parse page boundaries: %w", err)
+	}
+
+	starts := make([]bool, len(pages))
+	for _, page := range answer.Starts {
+		if page >= 1 && page <= len(pages) {
+			starts[page-1] = true
+		}
+	}
+
+	return starts, resp.Usage, nil
+}
+
+// pageRange is a document within a scan, pages are numbered from 1
+type pageRange struct {
+	First int `json:"first"`
+	Last  int `json:"last"`
+}
+
+// findDocuments returns the documents in a scan. Separator sheets and blank pages end a document and are dropped.
+func findDocuments(db *sql.DB, pc *PipelineContext, pages []string) ([]pageRange, error) {
+	methods := splitMethods()
+	drop := make([]bool, len(pages))
+	starts := make([]bool, len(pages))
+
+	if slices.Contains(methods, splitSeparator) {
+		viper.SetDefault("split.separator_text", "SEPARATOR SHEET")
+		viper.SetDefault("split.separator_code", "PATCHT")
+
+		codes, err := separatorCodes(pc.Context, pc.Job.LocalFile, len(pages))
+		if err != nil {
+			return nil, err
+		}
+
+		text := normalizeName(viper.GetString("split.separator_text"))
+		for i, page := range pages {
+			if strings.Contains(normalizeName(page), text) || (len(codes) > i && codes[i] == viper.GetString("split.separator_code")) {
+				drop[i] = true
+			}
+		}
+	}
+
+	if slices.Contains(methods, splitBlank) {
+		viper.SetDefault("split.blank_threshold", 0.01)
+
+		coverage, err := inkCoverage(pc.Context, pc.Job.LocalFile)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, page := range pages {
+			// scanners leave specks on blank pages, so OCR has to agree that there is nothing
+			if i < len(coverage) && coverage[i] < viper.GetFloat64("split.blank_threshold") && len(strings.Fields(page)) < 5 {
+				drop[i] = true
+			}
+		}
+	}
+
+	if slices.Contains(methods, splitLLM) && len(pages) > 1 {
+		viper.SetDefault("split.model", classificationModel)
+		model := viper.GetString("split.model")
+
+		spent, err := storage.MonthlyCost(db, pc.Job.User, time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		b := userBudget(pc.Job.User)
+		if budgetModel := b.model(spent); budgetModel == "" {
+			pc.Logger.Warn("Monthly budget exhausted, splitting without the LLM", "spent", spent, "budget", b.Hard)
+			model = ""
+		} else if budgetModel != classificationModel {
+			pc.Logger.Info("Monthly budget reached, splitting with the cheaper model", "model", budgetModel, "spent", spent, "budget", b.Soft)
+			model = budgetModel
+		}
+
+		if model != "" {
+			llmStarts, usage, err := llmBoundaries(pc.Context, model, pages)
+			if usage.TotalTokens > 0 {
+				recordUsage(db, pc.Job, model, usage)
+			}
+			if err != nil {
+				return nil, err
+			}
+			starts = llmStarts
+		}
+	}
+
+	var documents []pageRange
+	open := false
+	for i := range pages {
+		if drop[i] {
+			open = false
+			continue
+		}
+		if !open || starts[i] {
+			documents = append(documents, pageRange{First: i + 1, Last: i + 1})
+			open = true
+			continue
+		}
+		documents[len(documents)-1].Last = i + 1
+	}
+
+	return documents, nil
+}
+
+// splitDocuments returns the documents of a scan. They are stored in the "split" artifact before
+// any child is added, so a retry adds the missing children even if the LLM answers differently.
+func splitDocuments(db *sql.DB, pc *PipelineContext, pages []string) ([]pageRange, error) {
+	var documents []pageRange
+	if artifact := pc.Artifact("split"); artifact != "" {
+		err := json.Unmarshal([]byte(artifact), &documents)
+		if err != nil {
+			return nil, fmt.Errorf("invalid split artifact: %w", err)
+		}
+		return documents, nil
+	}
+
+	documents, err := findDocuments(db, pc, pages)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(documents)
+	if err != nil {
+		return nil, err
+	}
+	pc.SetArtifact("split", string(b))
+
+	return documents, storage.UpdateJob(db, *pc.Job)
+}
+
+// extractPages writes a range of pages of a PDF to a new file
+func extractPages(ctx context.Context, file string, r pageRange, output string) error {
+	out, err := exec.CommandContext(ctx, "gs", "-q", "-o", output, "-sDEVICE=pdfwrite",
+		fmt.Sprintf("-dFirstPage=%d", r.First), fmt.Sprintf("-dLastPage=%d", r.Last), file).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to extract pages %d-%d: %w: %s", r.First, r.Last, err, out)
+	}
+	return nil
+}
+
+// childFile names the part of a scan, e.g. scan#2.pdf
+func childFile(file string, n int) string {
+	ext := filepath.Ext(file)
+	return fmt.Sprintf("%s#%d%s", strings.TrimSuffix(file, ext), n, ext)
+}
+
+// splitStage splits scans with several documents into child jobs that are classified and uploaded
+// on their own, the scan itself is finished. Children start at this stage, it lets them pass.
+func splitStage(db *sql.DB, pc *PipelineContext) error {
+	job := pc.Job
+	if len(splitMethods()) == 0 || job.ParentID != 0 {
+		return nil
+	}
+
+	pages := pageTexts(job.OCR)
+	if len(pages) < 2 {
+		return nil
+	}
+
+	documents, err := splitDocuments(db, pc, pages)
+	if err != nil {
+		return err
+	}
+	if len(documents) < 2 {
+		return nil
+	}
+
+	// children are added one by one, so a retry doesn't add them twice
+	var children []string
+	if pc.Artifact("children") != "" {
+		children = strings.Split(pc.Artifact("children"), ",")
+	}
+
+	for n := len(children); n < len(documents); n++ {
+		r := documents[n]
+
+		child := *job
+		child.ParentID = job.ID
+		child.File = childFile(job.File, n+1)
+		child.LocalFile = filepath.Join(filepath.Dir(job.LocalFile), fmt.Sprintf("%d-%d.pdf", job.ID, n+1))
+		child.OCR = strings.Join(pages[r.First-1:r.Last], "\f")
+		child.Hash = ""
+		child.MinHash = ""
+		child.Artifacts = maps.Clone(job.Artifacts)
+		delete(child.Artifacts, "sha256")
+		delete(child.Artifacts, "children")
+		delete(child.Artifacts, "split")
+
+		err := extractPages(pc.Context, job.LocalFile, r, child.LocalFile)
+		if err != nil {
+			return err
+		}
+
+		id, err := storage.CloneJob(db, child, pc.Stage)
+		if err != nil {
+			os.Remove(child.LocalFile)
+			return err
+		}
+
+		pc.Logger.Info("Split document", "child", id, "pages", fmt.Sprintf("%d-%d", r.First, r.Last))
+		children = append(children, strconv.FormatInt(id, 10))
+		pc.SetArtifact("children", strings.Join(children, ","))
+
+		// the job is only saved after the stage, a crash in between must not add the child again
+		err = storage.UpdateJob(db, *job)
+		if err != nil {
+			return err
+		}
+	}
+
+	if telegramConfigured(job.User) {
+		err = sendTelegramMessage(job.User, fmt.Sprintf("Split file: %s\n\nIt contains %d documents, they are classified one by one", html.EscapeString(job.File), len(documents)))
+		if err != nil {
+			pc.Logger.Warn("Error sending Telegram message", "error", err)
+		}
+	}
+
+	// the children have their own copies
+	err = os.Remove(job.LocalFile)
+	if err != nil {
+		pc.Logger.Warn("Error removing spooled file", "file", job.LocalFile, "error", err)
+	}
+
+	return errJobFinished
+}
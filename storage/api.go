@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// jobResponse is a job together with the jobs that were detected as its duplicates
+type jobResponse struct {
+	Job
+	Duplicates []int64 `json:"duplicates"`
+}
+
+// requireToken only lets requests with the given bearer token through
+func requireToken(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			auth := c.Request().Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// listJobs returns the job history, filtered by the user and state query parameters
+func listJobs(c echo.Context) error {
+	ac := c.(*AppContext)
+
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+
+	jobs, err := ListJobs(ac.DB, JobFilter{
+		User:   c.QueryParam("user"),
+		State:  JobState(c.QueryParam("state")),
+		Limit:  limit,
+		Offset: offset,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, jobs)
+}
+
+// confirmJob confirms the classification of a job, a category in the body corrects it:
+//
+//	POST /api/jobs/:id/confirm {"category": "tk"}
+func confirmJob(c echo.Context) error {
+	ac := c.(*AppContext)
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid job id"})
+	}
+
+	var body struct {
+		Category string `json:"category"`
+	}
+	if c.Request().ContentLength != 0 {
+		err = c.Bind(&body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid body"})
+		}
+	}
+
+	ok, err := ConfirmJob(ac.DB, id, body.Category)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "job not found"})
+	}
+
+	return getJob(c)
+}
+
+// getUsage returns the monthly token usage and cost, filtered by the user and month (YYYY-MM) query parameters
+func getUsage(c echo.Context) error {
+	ac := c.(*AppContext)
+
+	usage, err := MonthlyUsage(ac.DB, c.QueryParam("user"), c.QueryParam("month"))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, usage)
+}
+
+// getJob returns a single job and its duplicates
+func getJob(c echo.Context) error {
+	ac := c.(*AppContext)
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid job id"})
+	}
+
+	job, err := GetJob(ac.DB, id)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if job == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "job not found"})
+	}
+
+	duplicates, err := DuplicatesOf(ac.DB, id)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, jobResponse{*job, duplicates})
+}
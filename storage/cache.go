@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CacheEntry holds the OCR text and classification of a file, keyed by the SHA-256 of its content
+type CacheEntry struct {
+	Hash           string
+	OCR            string
+	Classification *Classification
+	// PromptVersion and Model produced the classification
+	PromptVersion string
+	Model         string
+	CreatedAt     time.Time
+}
+
+// GetCacheEntry returns the cache entry for a hash, or nil if there is none
+func GetCacheEntry(db *sql.DB, hash string) (*CacheEntry, error) {
+	selectSQL := `SELECT hash, ocr, classification, prompt_version, model, created_at FROM cache WHERE hash = ?`
+
+	var entry CacheEntry
+	var classification sql.NullString
+	err := db.QueryRow(selectSQL, hash).Scan(&entry.Hash, &entry.OCR, &classification, &entry.PromptVersion, &entry.Model, &entry.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cache: %w", err)
+	}
+
+	if classification.Valid {
+		entry.Classification = &Classification{}
+		err = json.Unmarshal([]byte(classification.String), entry.Classification)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse cached classification: %w", err)
+		}
+	}
+
+	return &entry, nil
+}
+
+// CacheOCR stores the OCR text of a file
+func CacheOCR(db *sql.DB, hash string, ocr string) error {
+	insertSQL := `INSERT INTO cache (hash, ocr) VALUES (?, ?)
+	              ON CONFLICT(hash) DO UPDATE SET ocr=excluded.ocr`
+
+	_, err := db.Exec(insertSQL, hash, ocr)
+	if err != nil {
+		return fmt.Errorf("unable to cache OCR text: %w", err)
+	}
+
+	return nil
+}
+
+// CacheClassification stores the classification of a file together with what produced it
+func CacheClassification(db *sql.DB, hash string, classification Classification, promptVersion string, model string) error {
+	b, err := json.Marshal(classification)
+	if err != nil {
+		return err
+	}
+
+	insertSQL := `INSERT INTO cache (hash, classification, prompt_version, model) VALUES (?, ?, ?, ?)
+	              ON CONFLICT(hash) DO UPDATE SET
+	              classification=excluded.classification,
+	              prompt_version=excluded.prompt_version,
+	              model=excluded.model`
+
+	_, err = db.Exec(insertSQL, hash, string(b), promptVersion, model)
+	if err != nil {
+		return fmt.Errorf("unable to cache classification: %w", err)
+	}
+
+	return nil
+}
+
+// ForgetClassification removes the cached classification of a hash, the OCR text is kept
+func ForgetClassification(db *sql.DB, hash string) error {
+	_, err := db.Exec(`UPDATE cache SET classification = NULL, prompt_version = '', model = '' WHERE hash = ?`, hash)
+	if err != nil {
+		return fmt.Errorf("unable to forget cached classification: %w", err)
+	}
+
+	return nil
+}
+
+// InvalidateCache removes the entries for a hash, or all entries if hash is empty, including those of the
+// eval command. It returns the number of removed entries.
+func InvalidateCache(db *sql.DB, hash string) (int64, error) {
+	var removed int64
+	for _, table := range []string{"cache", "eval_cache"} {
+		var res sql.Result
+		var err error
+		if hash == "" {
+			res, err = db.Exec(fmt.Sprintf(`DELETE FROM %s`, table))
+		} else {
+			res, err = db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE hash = ?`, table), hash)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("unable to invalidate cache: %w", err)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		removed += n
+	}
+
+	return removed, nil
+}
+
+// EvalEntry is a cached classification of the eval command
+type EvalEntry struct {
+	Classification Classification
+	Cost           float64
+}
+
+// GetEvalEntry returns the cached classification of a file by a model and prompt, or nil if there is none
+func GetEvalEntry(db *sql.DB, hash string, model string, promptVersion string) (*EvalEntry, error) {
+	selectSQL := `SELECT classification, cost FROM eval_cache WHERE hash = ? AND model = ? AND prompt_version = ?`
+
+	var entry EvalEntry
+	var classification string
+	err := db.QueryRow(selectSQL, hash, model, promptVersion).Scan(&classification, &entry.Cost)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read eval cache: %w", err)
+	}
+
+	err = json.Unmarshal([]byte(classification), &entry.Classification)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse cached classification: %w", err)
+	}
+
+	return &entry, nil
+}
+
+// CacheEval stores a classification of the eval command. It is kept apart from the cache of the
+// daemon so comparing models doesn't evict the classifications used in production.
+func CacheEval(db *sql.DB, hash string, model string, promptVersion string, entry EvalEntry) error {
+	b, err := json.Marshal(entry.Classification)
+	if err != nil {
+		return err
+	}
+
+	insertSQL := `INSERT INTO eval_cache (hash, model, prompt_version, classification, cost) VALUES (?, ?, ?, ?, ?)
+	              ON CONFLICT(hash, model, prompt_version) DO UPDATE SET
+	              classification=excluded.classification,
+	              cost=excluded.cost`
+
+	_, err = db.Exec(insertSQL, hash, model, promptVersion, string(b), entry.Cost)
+	if err != nil {
+		return fmt.Errorf("unable to cache eval classification: %w", err)
+	}
+
+	return nil
+}
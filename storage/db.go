@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// OpenDB opens the sqlite database and creates all tables
+func OpenDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open db: %w", err)
+	}
+
+	// sqlite only allows one writer, serialize access instead of failing with "database is locked"
+	db.SetMaxOpenConns(1)
+
+	createTablesSQL := `CREATE TABLE IF NOT EXISTS oauth_tokens (
+		"user_id" TEXT PRIMARY KEY,
+		"refresh_token" TEXT NOT NULL,
+		"token_type" TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS jobs (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"user" TEXT NOT NULL,
+		"file" TEXT NOT NULL,
+		"title" TEXT NOT NULL DEFAULT '',
+		"category" TEXT NOT NULL DEFAULT '',
+		"provider" TEXT NOT NULL DEFAULT '',
+		"path" TEXT NOT NULL DEFAULT '',
+		"url" TEXT NOT NULL DEFAULT '',
+		"duplicate" INTEGER NOT NULL DEFAULT 0,
+		"created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		"remote_size" INTEGER NOT NULL DEFAULT 0,
+		"remote_time" INTEGER NOT NULL DEFAULT 0,
+		"state" TEXT NOT NULL DEFAULT 'pending',
+		"stage" TEXT NOT NULL DEFAULT '',
+		"attempts" INTEGER NOT NULL DEFAULT 0,
+		"next_attempt_at" INTEGER NOT NULL DEFAULT 0,
+		"last_error" TEXT NOT NULL DEFAULT '',
+		"local_file" TEXT NOT NULL DEFAULT '',
+		"ocr" TEXT NOT NULL DEFAULT '',
+		"classification" TEXT NOT NULL DEFAULT '{}',
+		"artifacts" TEXT NOT NULL DEFAULT 'null',
+		"hash" TEXT NOT NULL DEFAULT '',
+		"minhash" TEXT NOT NULL DEFAULT '',
+		"duplicate_of" INTEGER NOT NULL DEFAULT 0,
+		"similarity" REAL NOT NULL DEFAULT 0,
+		"confirmed" INTEGER NOT NULL DEFAULT 0,
+		"model" TEXT NOT NULL DEFAULT '',
+		"prompt_version" TEXT NOT NULL DEFAULT '',
+		"variant" TEXT NOT NULL DEFAULT '',
+		"parent_id" INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS jobs_queue ON jobs (state, stage, next_attempt_at);
+	CREATE INDEX IF NOT EXISTS jobs_user_file ON jobs (user, file);
+	CREATE INDEX IF NOT EXISTS jobs_hash ON jobs (hash);
+	CREATE INDEX IF NOT EXISTS jobs_duplicate_of ON jobs (duplicate_of);
+	CREATE TABLE IF NOT EXISTS cache (
+		"hash" TEXT PRIMARY KEY,
+		"ocr" TEXT NOT NULL DEFAULT '',
+		"classification" TEXT,
+		"prompt_version" TEXT NOT NULL DEFAULT '',
+		"model" TEXT NOT NULL DEFAULT '',
+		"created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS eval_cache (
+		"hash" TEXT NOT NULL,
+		"model" TEXT NOT NULL,
+		"prompt_version" TEXT NOT NULL,
+		"classification" TEXT NOT NULL,
+		"cost" REAL NOT NULL DEFAULT 0,
+		"created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (hash, model, prompt_version)
+	);
+	CREATE TABLE IF NOT EXISTS usage (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"user" TEXT NOT NULL,
+		"job_id" INTEGER NOT NULL DEFAULT 0,
+		"model" TEXT NOT NULL,
+		"prompt_tokens" INTEGER NOT NULL,
+		"completion_tokens" INTEGER NOT NULL,
+		"cost" REAL NOT NULL,
+		"created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS usage_user_created_at ON usage (user, created_at);
+	CREATE TABLE IF NOT EXISTS embeddings (
+		"job_id" INTEGER PRIMARY KEY,
+		"user" TEXT NOT NULL,
+		"model" TEXT NOT NULL,
+		"vector" BLOB NOT NULL,
+		"created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS embeddings_user_model ON embeddings (user, model);`
+
+	_, err = db.Exec(createTablesSQL)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to create tables: %w", err)
+	}
+
+	return db, nil
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Neighbour is a classified job with the embedding of its OCR text
+type Neighbour struct {
+	JobID     int64
+	Hash      string
+	Category  string
+	Confirmed bool
+	// Source is the classifier that labelled the job, see the "classifier" artifact
+	Source string
+	// Title and Sender of the job's classification, k-NN classifications borrow them
+	Title  string
+	Sender string
+	Vector []float32
+}
+
+func encodeVector(vector []float32) []byte {
+	b := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(v))
+	}
+	return b
+}
+
+func decodeVector(b []byte) []float32 {
+	vector := make([]float32, len(b)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return vector
+}
+
+// SaveEmbedding stores the embedding of a job's OCR text
+func SaveEmbedding(db *sql.DB, jobID int64, user string, model string, vector []float32) error {
+	insertSQL := `INSERT INTO embeddings (job_id, user, model, vector) VALUES (?, ?, ?, ?)
+	              ON CONFLICT(job_id) DO UPDATE SET
+	              model=excluded.model,
+	              vector=excluded.vector`
+
+	_, err := db.Exec(insertSQL, jobID, user, model, encodeVector(vector))
+	if err != nil {
+		return fmt.Errorf("unable to save embedding: %w", err)
+	}
+
+	return nil
+}
+
+// UserNeighbours returns the embeddings of all finished and classified jobs of a user made with the given model
+func UserNeighbours(db *sql.DB, user string, model string) ([]Neighbour, error) {
+	selectSQL := `SELECT j.id, j.hash, j.category, j.confirmed, COALESCE(json_extract(j.artifacts, '$.classifier'), ''),
+	              COALESCE(json_extract(j.classification, '$.title'), ''), COALESCE(json_extract(j.classification, '$.sender'), ''), e.vector
+	              FROM embeddings e JOIN jobs j ON j.id = e.job_id
+	              WHERE e.user = ? AND e.model = ? AND j.state = ? AND j.category != ''`
+
+	rows, err := db.Query(selectSQL, user, model, JobDone)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list embeddings: %w", err)
+	}
+	defer rows.Close()
+
+	var neighbours []Neighbour
+	for rows.Next() {
+		var n Neighbour
+		var vector []byte
+		err := rows.Scan(&n.JobID, &n.Hash, &n.Category, &n.Confirmed, &n.Source, &n.Title, &n.Sender, &vector)
+		if err != nil {
+			return nil, err
+		}
+		n.Vector = decodeVector(vector)
+		neighbours = append(neighbours, n)
+	}
+
+	return neighbours, rows.Err()
+}
+
+// JobsWithoutEmbedding returns the finished jobs with OCR text that have no embedding of the given model
+func JobsWithoutEmbedding(db *sql.DB, model string) ([]Job, error) {
+	selectSQL := fmt.Sprintf(`SELECT %s FROM jobs WHERE state = ? AND ocr != ''
+	              AND id NOT IN (SELECT job_id FROM embeddings WHERE model = ?) ORDER BY id`, jobColumns)
+
+	rows, err := db.Query(selectSQL, JobDone, model)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list jobs without embedding: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
@@ -1,11 +1,20 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"expvar"
 	"fmt"
-	"os"
 	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	_ "github.com/mattn/go-sqlite3"
@@ -33,19 +42,19 @@ func saveToken(db *sql.DB, userID string, token *oauth2.Token) error {
 }
 
 func getToken(db *sql.DB, userID string) (*oauth2.Token, error) {
-    selectSQL := `SELECT refresh_token, token_type FROM oauth_tokens WHERE user_id = ?`
-
-    row := db.QueryRow(selectSQL, userID)
-    var refreshToken, tokenType string
-    err := row.Scan(&refreshToken, &tokenType)
-    if err != nil {
-        return nil, err
-    }
-
-    return &oauth2.Token{
-        RefreshToken: refreshToken,
-        TokenType: tokenType,
-    }, nil
+	selectSQL := `SELECT refresh_token, token_type FROM oauth_tokens WHERE user_id = ?`
+
+	row := db.QueryRow(selectSQL, userID)
+	var refreshToken, tokenType string
+	err := row.Scan(&refreshToken, &tokenType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Token{
+		RefreshToken: refreshToken,
+		TokenType:    tokenType,
+	}, nil
 }
 
 func redirect(c echo.Context) error {
@@ -58,7 +67,8 @@ func callback(c echo.Context) error {
 	ac := c.(*AppContext)
 
 	code := c.QueryParam("code")
-	token, err := ac.Oauth2Config.Exchange(context.Background(), code)
+	ctx := c.Request().Context()
+	token, err := ac.Oauth2Config.Exchange(ctx, code)
 	if err != nil {
 		slog.Warn("Unable to retrieve token from web: %v", "error", err)
 		return c.String(500, "Unable to retrieve token from web")
@@ -67,7 +77,7 @@ func callback(c echo.Context) error {
 	slog.Info("Received token", "token", token)
 
 	// get email address
-	srv, err := drive.NewService(context.Background(), option.WithHTTPClient(ac.Oauth2Config.Client(context.Background(), token)))
+	srv, err := drive.NewService(ctx, option.WithHTTPClient(ac.Oauth2Config.Client(ctx, token)))
 	if err != nil {
 		slog.Warn("Unable to create Drive service", "error", err)
 		return c.String(500, "Unable to create Drive service")
@@ -88,94 +98,170 @@ func callback(c echo.Context) error {
 	return c.String(200, "Token saved successfully")
 }
 
-// getFolderID retrieves the ID of a folder with the given path and creates if it doesn't exist
-func getFolderID(srv *drive.Service, name string) (string, error) {
-    q := fmt.Sprintf("mimeType='application/vnd.google-apps.folder' and name='%s'", name)
-    r, err := srv.Files.List().Q(q).Do()
-    if err != nil {
-        return "", fmt.Errorf("unable to list files: %w", err)
-    }
-
-    if len(r.Files) == 0 {
-        f := &drive.File{
-            Name: name,
-            MimeType: "application/vnd.google-apps.folder",
-        }
-        f, err := srv.Files.Create(f).Do()
-        if err != nil {
-            return "", fmt.Errorf("unable to create folder: %w", err)
-        }
-        return f.Id, nil
-    }
-
-    return r.Files[0].Id, nil
+// LoadOAuth2Config loads the Google client secrets from a local file
+func LoadOAuth2Config(path string) (*oauth2.Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client secret file: %w", err)
+	}
+
+	// If modifying these scopes, delete your previously saved token.json.
+	config, err := google.ConfigFromJSON(b, drive.DriveFileScope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client secret file to config: %w", err)
+	}
+
+	// FIXME
+	config.RedirectURL = "http://localhost:8080/callback"
+
+	return config, nil
 }
 
-func StoreFile(db *sql.DB, userID string, data []byte, classification Classification) (string, error) {
-    token, err := getToken(db, userID)
-    if err != nil {
-        return "", fmt.Errorf("unable to retrieve token: %w", err)
-    }
-
-    srv, err := drive.NewService(context.Background(), option.WithHTTPClient(ac.Oauth2Config.Client(context.Background(), token)))
-    if err != nil {
-        return "", fmt.Errorf("unable to create Drive service: %w", err)
-    }
-
-    file := &drive.File{
-        Name: classification.FileName,
-        MimeType: "application/octet-stream",
-        Parents: []string{classification.Category},
-    }
+// driveQuote escapes a value for use in a Drive search query
+func driveQuote(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value) + "'"
 }
 
-func RunServer() {
-	slog.Info("Creating table...")
-	db, err := sql.Open("sqlite3", "./tokens.db")
+// getFolderID retrieves the ID of a folder with the given name inside parent and creates if it doesn't exist
+func getFolderID(ctx context.Context, srv *drive.Service, parentID string, name string) (string, error) {
+	q := fmt.Sprintf("mimeType='application/vnd.google-apps.folder' and title=%s and %s in parents and trashed=false", driveQuote(name), driveQuote(parentID))
+	r, err := srv.Files.List().Q(q).Context(ctx).Do()
 	if err != nil {
-        slog.Error("error opening db", "error", err)
-        panic(err)
+		return "", fmt.Errorf("unable to list files: %w", err)
+	}
+
+	if len(r.Items) == 0 {
+		f := &drive.File{
+			Title:    name,
+			MimeType: "application/vnd.google-apps.folder",
+			Parents:  []*drive.ParentReference{{Id: parentID}},
+		}
+		f, err := srv.Files.Insert(f).Context(ctx).Do()
+		if err != nil {
+			return "", fmt.Errorf("unable to create folder: %w", err)
+		}
+		return f.Id, nil
 	}
 
-	defer db.Close()
+	return r.Items[0].Id, nil
+}
+
+// GoogleDrive stores documents in the Drive of a user who authorized the app via /auth
+type GoogleDrive struct {
+	DB     *sql.DB
+	Config *oauth2.Config
+	// UserID is the email address the token was saved under
+	UserID string
 
-	createTableSQL := `CREATE TABLE IF NOT EXISTS oauth_tokens (
-		"user_id" TEXT PRIMARY KEY,
-		"refresh_token" TEXT NOT NULL,
-		"token_type" TEXT NOT NULL
-	);`
+	// Path renders the folder structure and name of a document
+	Path PathTemplate
 
-	_, err = db.Exec(createTableSQL)
+	// Collision decides what happens if a different file with the same name already exists
+	Collision CollisionStrategy
+}
+
+const DefaultGoogleDrivePathTemplate = `{{.Category}}/{{.FileName}}`
+
+func (g *GoogleDrive) StoreFile(ctx context.Context, data []byte, classification Classification) (StoredFile, error) {
+	token, err := getToken(g.DB, g.UserID)
 	if err != nil {
-        slog.Error("error creating table ", "error", err)
-        panic(err)
+		return StoredFile{}, fmt.Errorf("unable to retrieve token: %w", err)
 	}
 
-	slog.Info("Table created successfully.")
+	srv, err := drive.NewService(ctx, option.WithHTTPClient(g.Config.Client(ctx, token)))
+	if err != nil {
+		return StoredFile{}, fmt.Errorf("unable to create Drive service: %w", err)
+	}
 
-	// Load client secrets from a local file.
-	b, err := os.ReadFile("creds.json")
+	remotePath, err := g.Path.Render(classification, DefaultGoogleDrivePathTemplate)
 	if err != nil {
-		slog.Error("Unable to read client secret file", "error", err)
-        panic(err)
+		return StoredFile{}, err
 	}
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, drive.DriveFileScope)
+	folderID := "root"
+	dir := path.Dir(remotePath)
+	if dir != "." {
+		for _, segment := range strings.Split(dir, "/") {
+			folderID, err = getFolderID(ctx, srv, folderID, segment)
+			if err != nil {
+				return StoredFile{}, err
+			}
+		}
+	}
+
+	sum := md5.Sum(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	var existing *drive.File
+	name, duplicate, err := resolveCollision(path.Base(remotePath), data, g.Collision, func(name string) (bool, bool, error) {
+		q := fmt.Sprintf("title=%s and %s in parents and trashed=false", driveQuote(name), driveQuote(folderID))
+		r, err := srv.Files.List().Q(q).Context(ctx).Do()
+		if err != nil {
+			return false, false, fmt.Errorf("unable to list files: %w", err)
+		}
+
+		for _, f := range r.Items {
+			if f.Md5Checksum == checksum {
+				existing = f
+				return true, true, nil
+			}
+		}
+
+		return len(r.Items) > 0, false, nil
+	})
 	if err != nil {
-		slog.Error("Unable to parse client secret file to config", "error", err)
-        panic(err)
+		return StoredFile{}, err
 	}
 
-	// FIXME
-	config.RedirectURL = "http://localhost:8080/callback"
+	remotePath = path.Join(dir, name)
+
+	if duplicate {
+		slog.Info("File already exists in Google Drive with the same content, skipping upload", "path", remotePath)
+		return StoredFile{Path: remotePath, URL: existing.AlternateLink, Duplicate: true}, nil
+	}
+
+	file := &drive.File{
+		Title:    name,
+		MimeType: "application/pdf",
+		Parents:  []*drive.ParentReference{{Id: folderID}},
+	}
+
+	file, err = srv.Files.Insert(file).Media(bytes.NewReader(data)).Context(ctx).Do()
+	if err != nil {
+		return StoredFile{}, fmt.Errorf("unable to upload file: %w", err)
+	}
 
-	slog.Info("Config", "config", config)
+	slog.Info("Uploaded file to Google Drive", "path", remotePath)
+
+	return StoredFile{Path: remotePath, URL: file.AlternateLink}, nil
+}
 
+// RunServer serves the Google OAuth flow until ctx is cancelled, if creds.json exists. The job
+// history API and the metrics on /debug/vars are only served if an API token is set.
+func RunServer(ctx context.Context, db *sql.DB, apiToken string) error {
 	e := echo.New()
+	e.HideBanner = true
+
+	config, err := LoadOAuth2Config("creds.json")
+	if err != nil {
+		slog.Warn("Google Drive login disabled", "error", err)
+	} else {
+		slog.Info("Config", "config", config)
+
+		e.GET("/auth", redirect)
+		e.GET("/callback", callback)
+	}
+	if apiToken != "" {
+		// expvar also exposes the command line and memory statistics of the daemon
+		e.GET("/debug/vars", echo.WrapHandler(expvar.Handler()), requireToken(apiToken))
+
+		api := e.Group("/api", requireToken(apiToken))
+		api.GET("/jobs", listJobs)
+		api.GET("/jobs/:id", getJob)
+		api.POST("/jobs/:id/confirm", confirmJob)
+		api.GET("/usage", getUsage)
+	}
 
-	e.GET("/auth", redirect)
-	e.GET("/callback", callback)
 	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			cc := &AppContext{c, config, db}
@@ -183,5 +269,22 @@ func RunServer() {
 		}
 	})
 
-	e.Logger.Fatal(e.Start(":8080"))
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err := e.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Error("Error shutting down server", "error", err)
+		}
+	}()
+
+	err = e.Start(":8080")
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("unable to run server: %w", err)
+	}
+
+	return nil
 }
@@ -0,0 +1,483 @@
+package storage
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type JobState string
+
+const (
+	JobPending JobState = "pending"
+	JobRunning JobState = "running"
+	JobDone    JobState = "done"
+	// JobDead is the dead-letter state of jobs that ran out of attempts
+	JobDead JobState = "dead"
+	// JobWaiting is the state of jobs that wait for an answer of the user
+	JobWaiting JobState = "waiting"
+)
+
+// StageDone is the stage of jobs that went through the whole pipeline
+const StageDone = "done"
+
+// Job is a scan moving through the pipeline. Finished jobs make up the job history.
+type Job struct {
+	ID       int64  `json:"id"`
+	User     string `json:"user"`
+	File     string `json:"file"`
+	Title    string `json:"title"`
+	Category string `json:"category"`
+	Provider string `json:"provider"`
+	Path     string `json:"path"`
+	URL      string `json:"url"`
+	// Duplicate is true if the provider already had the same content and nothing was uploaded
+	Duplicate bool      `json:"duplicate"`
+	CreatedAt time.Time `json:"created_at"`
+	// RemoteSize and RemoteTime identify the version of the file on the FTP server
+	RemoteSize int64     `json:"remote_size"`
+	RemoteTime time.Time `json:"remote_time"`
+
+	State         JobState  `json:"state"`
+	Stage         string    `json:"stage"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error"`
+
+	// artifacts of earlier stages, so a failed stage can be retried without redoing the others
+	LocalFile      string         `json:"local_file"`
+	OCR            string         `json:"-"`
+	Classification Classification `json:"classification"`
+	// Artifacts holds outputs of additional stages
+	Artifacts map[string]string `json:"artifacts"`
+
+	// Hash is the SHA-256 of the file and MinHash the signature of its OCR text, both are used to find duplicates
+	Hash    string `json:"sha256"`
+	MinHash string `json:"-"`
+	// DuplicateOf is the id of an earlier job with the same or a very similar document
+	DuplicateOf int64   `json:"duplicate_of"`
+	Similarity  float64 `json:"similarity"`
+
+	// Confirmed is true once the user confirmed or corrected the classification
+	Confirmed bool `json:"confirmed"`
+
+	// Model and PromptVersion produced the classification, they are empty if the LLM wasn't asked.
+	// Variant is the experiment variant the job was routed to.
+	Model         string `json:"model"`
+	PromptVersion string `json:"prompt_version"`
+	Variant       string `json:"variant,omitempty"`
+
+	// ParentID is the id of the scan a job was split from
+	ParentID int64 `json:"parent_id,omitempty"`
+}
+
+const jobColumns = `id, user, file, title, category, provider, path, url, duplicate, created_at, remote_size, remote_time,
+	state, stage, attempts, next_attempt_at, last_error, local_file, ocr, classification, artifacts,
+	hash, minhash, duplicate_of, similarity, confirmed, model, prompt_version, variant, parent_id`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanJob(row rowScanner) (Job, error) {
+	var job Job
+	var nextAttemptAt, remoteTime int64
+	var classification, artifacts string
+
+	err := row.Scan(&job.ID, &job.User, &job.File, &job.Title, &job.Category, &job.Provider, &job.Path, &job.URL, &job.Duplicate, &job.CreatedAt, &job.RemoteSize, &remoteTime,
+		&job.State, &job.Stage, &job.Attempts, &nextAttemptAt, &job.LastError, &job.LocalFile, &job.OCR, &classification, &artifacts,
+		&job.Hash, &job.MinHash, &job.DuplicateOf, &job.Similarity, &job.Confirmed, &job.Model, &job.PromptVersion, &job.Variant, &job.ParentID)
+	if err != nil {
+		return Job{}, err
+	}
+
+	job.NextAttemptAt = time.Unix(nextAttemptAt, 0)
+	job.RemoteTime = time.Unix(remoteTime, 0)
+
+	err = json.Unmarshal([]byte(classification), &job.Classification)
+	if err != nil {
+		return Job{}, fmt.Errorf("unable to parse classification of job %d: %w", job.ID, err)
+	}
+
+	err = json.Unmarshal([]byte(artifacts), &job.Artifacts)
+	if err != nil {
+		return Job{}, fmt.Errorf("unable to parse artifacts of job %d: %w", job.ID, err)
+	}
+
+	return job, nil
+}
+
+// EnqueueJob adds a new file to the queue at the given stage, it returns false if the file is already known.
+// Scanners reuse names like scan0001.pdf, so a finished job only covers the file with the same size and
+// modification time, while a job in progress covers any file with its name.
+func EnqueueJob(db *sql.DB, user string, file string, size int64, modTime time.Time, stage string) (bool, error) {
+	insertSQL := `INSERT INTO jobs (user, file, remote_size, remote_time, state, stage)
+	              SELECT ?, ?, ?, ?, ?, ?
+	              WHERE NOT EXISTS (SELECT 1 FROM jobs WHERE user = ? AND file = ?
+	                                AND (state NOT IN (?, ?) OR (remote_size = ? AND remote_time = ?)))`
+
+	res, err := db.Exec(insertSQL, user, file, size, modTime.Unix(), JobPending, stage,
+		user, file, JobDone, JobDead, size, modTime.Unix())
+	if err != nil {
+		return false, fmt.Errorf("unable to enqueue job: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// ClaimJob marks the oldest due job in one of the given stages as running and returns it.
+// It returns nil if there is nothing to do.
+func ClaimJob(db *sql.DB, stages []string) (*Job, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(stages)), ", ")
+
+	args := []any{JobRunning, JobPending}
+	for _, stage := range stages {
+		args = append(args, stage)
+	}
+	args = append(args, time.Now().Unix())
+
+	claimSQL := fmt.Sprintf(`UPDATE jobs SET state = ?
+	              WHERE id = (SELECT id FROM jobs WHERE state = ? AND stage IN (%s) AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT 1)
+	              RETURNING %s`, placeholders, jobColumns)
+
+	job, err := scanJob(db.QueryRow(claimSQL, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to claim job: %w", err)
+	}
+
+	return &job, nil
+}
+
+// UpdateJob saves the state and artifacts of a job
+func UpdateJob(db *sql.DB, job Job) error {
+	classification, err := json.Marshal(job.Classification)
+	if err != nil {
+		return err
+	}
+
+	artifacts, err := json.Marshal(job.Artifacts)
+	if err != nil {
+		return err
+	}
+
+	updateSQL := `UPDATE jobs SET title = ?, category = ?, provider = ?, path = ?, url = ?, duplicate = ?,
+	              state = ?, stage = ?, attempts = ?, next_attempt_at = ?, last_error = ?, local_file = ?, ocr = ?, classification = ?, artifacts = ?,
+	              hash = ?, minhash = ?, duplicate_of = ?, similarity = ?, model = ?, prompt_version = ?, variant = ?
+	              WHERE id = ?`
+
+	_, err = db.Exec(updateSQL, job.Classification.Title, job.Classification.Category, job.Provider, job.Path, job.URL, job.Duplicate,
+		job.State, job.Stage, job.Attempts, job.NextAttemptAt.Unix(), job.LastError, job.LocalFile, job.OCR, string(classification), string(artifacts),
+		job.Hash, job.MinHash, job.DuplicateOf, job.Similarity, job.Model, job.PromptVersion, job.Variant, job.ID)
+	if err != nil {
+		return fmt.Errorf("unable to update job %d: %w", job.ID, err)
+	}
+
+	return nil
+}
+
+// ResetRunningJobs puts jobs that were interrupted by a restart back into the queue
+func ResetRunningJobs(db *sql.DB) (int64, error) {
+	res, err := db.Exec(`UPDATE jobs SET state = ? WHERE state = ?`, JobPending, JobRunning)
+	if err != nil {
+		return 0, fmt.Errorf("unable to reset running jobs: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// QueueDepth returns the number of jobs that are not finished yet
+func QueueDepth(db *sql.DB) (int, error) {
+	var depth int
+	err := db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE state IN (?, ?)`, JobPending, JobRunning).Scan(&depth)
+	return depth, err
+}
+
+// GetJob returns a job by id, or nil if it doesn't exist
+func GetJob(db *sql.DB, id int64) (*Job, error) {
+	job, err := scanJob(db.QueryRow(fmt.Sprintf(`SELECT %s FROM jobs WHERE id = ?`, jobColumns), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get job %d: %w", id, err)
+	}
+
+	return &job, nil
+}
+
+// JobFilter restricts the jobs returned by ListJobs, empty fields match everything
+type JobFilter struct {
+	User   string
+	State  JobState
+	Limit  int
+	Offset int
+}
+
+// ListJobs returns jobs matching the filter, newest first
+func ListJobs(db *sql.DB, filter JobFilter) ([]Job, error) {
+	var conditions []string
+	var args []any
+	if filter.User != "" {
+		conditions = append(conditions, "user = ?")
+		args = append(args, filter.User)
+	}
+	if filter.State != "" {
+		conditions = append(conditions, "state = ?")
+		args = append(args, filter.State)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	args = append(args, limit, filter.Offset)
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT %s FROM jobs %s ORDER BY id DESC LIMIT ? OFFSET ?`, jobColumns, where), args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// ClassifiedJobs returns all finished jobs with OCR text and a category
+func ClassifiedJobs(db *sql.DB) ([]Job, error) {
+	rows, err := db.Query(fmt.Sprintf(`SELECT %s FROM jobs WHERE state = ? AND ocr != '' AND category != '' ORDER BY id`, jobColumns), JobDone)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list classified jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// ConfirmedJobs returns the jobs of a user whose classification was confirmed or corrected
+func ConfirmedJobs(db *sql.DB, user string) ([]Job, error) {
+	rows, err := db.Query(fmt.Sprintf(`SELECT %s FROM jobs WHERE user = ? AND confirmed = 1 AND ocr != '' ORDER BY id`, jobColumns), user)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list confirmed jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// ConfirmJob marks the classification of a job as confirmed by the user. A non-empty category
+// corrects the classification. It returns false if the job doesn't exist.
+func ConfirmJob(db *sql.DB, id int64, category string) (bool, error) {
+	job, err := GetJob(db, id)
+	if err != nil || job == nil {
+		return false, err
+	}
+
+	if category != "" && category != job.Classification.Category {
+		job.Classification.Explanation = fmt.Sprintf("Corrected from %s by the user.", job.Classification.Category)
+		job.Classification.Category = category
+		if job.Artifacts == nil {
+			job.Artifacts = make(map[string]string)
+		}
+		job.Artifacts["classifier"] = "user"
+	}
+
+	classification, err := json.Marshal(job.Classification)
+	if err != nil {
+		return false, err
+	}
+
+	artifacts, err := json.Marshal(job.Artifacts)
+	if err != nil {
+		return false, err
+	}
+
+	// only touch the classification, the job might still be running
+	updateSQL := `UPDATE jobs SET category = ?, classification = ?, artifacts = ?, confirmed = 1 WHERE id = ?`
+
+	_, err = db.Exec(updateSQL, job.Classification.Category, string(classification), string(artifacts), id)
+	if err != nil {
+		return false, fmt.Errorf("unable to confirm job %d: %w", id, err)
+	}
+
+	// the cached classification was wrong, a re-scan has to ask again with the correction as example
+	hash := cmp.Or(job.Hash, job.Artifacts["sha256"])
+	if job.Artifacts["classifier"] == "user" && hash != "" {
+		err = ForgetClassification(db, hash)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// Categories returns the categories a user's documents were filed under, most used first
+func Categories(db *sql.DB, user string) ([]string, error) {
+	rows, err := db.Query(`SELECT category FROM jobs WHERE user = ? AND category != '' GROUP BY category ORDER BY COUNT(*) DESC, category`, user)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list categories: %w", err)
+	}
+	defer rows.Close()
+
+	var categories []string
+	for rows.Next() {
+		var category string
+		err := rows.Scan(&category)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+
+	return categories, rows.Err()
+}
+
+// FindJobByHash returns the oldest job before the given one with the same file hash, or nil if there is none.
+// Dead jobs never made it into the archive and are ignored.
+func FindJobByHash(db *sql.DB, hash string, before int64) (*Job, error) {
+	selectSQL := fmt.Sprintf(`SELECT %s FROM jobs WHERE hash = ? AND id < ? AND state != ? ORDER BY id LIMIT 1`, jobColumns)
+
+	job, err := scanJob(db.QueryRow(selectSQL, hash, before, JobDead))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to find job by hash: %w", err)
+	}
+
+	return &job, nil
+}
+
+// JobSignatures returns the MinHash signatures of all jobs before the given one by job id
+func JobSignatures(db *sql.DB, before int64) (map[int64]string, error) {
+	rows, err := db.Query(`SELECT id, minhash FROM jobs WHERE minhash != '' AND id < ? AND state != ?`, before, JobDead)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list signatures: %w", err)
+	}
+	defer rows.Close()
+
+	signatures := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var signature string
+		err := rows.Scan(&id, &signature)
+		if err != nil {
+			return nil, err
+		}
+		signatures[id] = signature
+	}
+
+	return signatures, rows.Err()
+}
+
+// DuplicatesOf returns the ids of all jobs that were detected as duplicates of a job
+func DuplicatesOf(db *sql.DB, id int64) ([]int64, error) {
+	rows, err := db.Query(`SELECT id FROM jobs WHERE duplicate_of = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list duplicates: %w", err)
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var duplicate int64
+		err := rows.Scan(&duplicate)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, duplicate)
+	}
+
+	return ids, rows.Err()
+}
+
+// ExperimentJobs returns the finished jobs classified by the LLM since a point in time, they are
+// used to compare prompt versions and models
+func ExperimentJobs(db *sql.DB, since time.Time) ([]Job, error) {
+	selectSQL := fmt.Sprintf(`SELECT %s FROM jobs WHERE state = ? AND prompt_version != '' AND created_at >= ? ORDER BY id`, jobColumns)
+
+	rows, err := db.Query(selectSQL, JobDone, since.UTC().Format(time.DateTime))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list experiment jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// CloneJob adds a copy of a job, e.g. with another user, that starts at the given stage. It returns the id of the copy.
+func CloneJob(db *sql.DB, job Job, stage string) (int64, error) {
+	classification, err := json.Marshal(job.Classification)
+	if err != nil {
+		return 0, err
+	}
+
+	artifacts, err := json.Marshal(job.Artifacts)
+	if err != nil {
+		return 0, err
+	}
+
+	insertSQL := `INSERT INTO jobs (user, file, title, category, state, stage, local_file, ocr, classification, artifacts,
+	              hash, minhash, duplicate_of, similarity, model, prompt_version, variant, parent_id)
+	              VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	res, err := db.Exec(insertSQL, job.User, job.File, job.Classification.Title, job.Classification.Category, JobPending, stage, job.LocalFile, job.OCR,
+		string(classification), string(artifacts), job.Hash, job.MinHash, job.DuplicateOf, job.Similarity, job.Model, job.PromptVersion, job.Variant, job.ParentID)
+	if err != nil {
+		return 0, fmt.Errorf("unable to clone job %d: %w", job.ID, err)
+	}
+
+	return res.LastInsertId()
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Nextcloud stores documents via WebDAV and makes the classification visible in the
+// Nextcloud UI using collaborative tags, comments and share links
+type Nextcloud struct {
+	WebDAV
+
+	// Tags assigns system tags for the category, sender and year
+	Tags bool
+	// Comment posts the explanation as a file comment
+	Comment bool
+	// ShareLink returns a public share link instead of the internal /f/<fileid> link
+	ShareLink bool
+	// ShareExpiry is how long share links are valid, zero means they don't expire
+	ShareExpiry time.Duration
+}
+
+func (n *Nextcloud) rootURL(p string) string {
+	return strings.TrimSuffix(n.URL, "/") + p
+}
+
+func (n *Nextcloud) propfind(ctx context.Context, url string, props string) (davMultistatus, error) {
+	body := `<?xml version="1.0"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns"><d:prop>` + props + `</d:prop></d:propfind>`
+
+	resp, err := n.request(ctx, "PROPFIND", url, http.Header{"Depth": {"1"}, "Content-Type": {"application/xml"}}, strings.NewReader(body))
+	if err != nil {
+		return davMultistatus{}, fmt.Errorf("unable to send PROPFIND request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return davMultistatus{}, fmt.Errorf("unexpected PROPFIND status: %s", resp.Status)
+	}
+
+	var ms davMultistatus
+	err = xml.NewDecoder(resp.Body).Decode(&ms)
+	if err != nil {
+		return davMultistatus{}, fmt.Errorf("unable to parse PROPFIND response: %w", err)
+	}
+
+	return ms, nil
+}
+
+// fileID returns the numeric Nextcloud file id of a path relative to BasePath
+func (n *Nextcloud) fileID(ctx context.Context, remotePath string) (string, error) {
+	ms, err := n.propfind(ctx, n.fileURL(remotePath), "<oc:fileid/>")
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if ps.Prop.FileID != "" {
+				return ps.Prop.FileID, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no file id for %s", remotePath)
+}
+
+// tagID looks up a system tag by name and creates it if it doesn't exist
+func (n *Nextcloud) tagID(ctx context.Context, name string) (string, error) {
+	ms, err := n.propfind(ctx, n.rootURL("/remote.php/dav/systemtags/"), "<oc:id/><oc:display-name/>")
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if ps.Prop.ID != "" && strings.EqualFold(ps.Prop.DisplayName, name) {
+				return ps.Prop.ID, nil
+			}
+		}
+	}
+
+	slog.Info("Creating Nextcloud system tag", "tag", name)
+
+	body, _ := json.Marshal(map[string]any{
+		"name":           name,
+		"userVisible":    true,
+		"userAssignable": true,
+		"canAssign":      true,
+	})
+	resp, err := n.request(ctx, "POST", n.rootURL("/remote.php/dav/systemtags/"), http.Header{"Content-Type": {"application/json"}}, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("unable to create tag: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("unable to create tag %s: %s", name, resp.Status)
+	}
+
+	// the new tag id is the last segment of Content-Location
+	return path.Base(resp.Header.Get("Content-Location")), nil
+}
+
+func (n *Nextcloud) assignTag(ctx context.Context, fileID string, name string) error {
+	id, err := n.tagID(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.request(ctx, "PUT", n.rootURL(fmt.Sprintf("/remote.php/dav/systemtags-relations/files/%s/%s", fileID, id)), nil, nil)
+	if err != nil {
+		return fmt.Errorf("unable to assign tag: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// 409 means the tag is already assigned
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("unable to assign tag %s: %s", name, resp.Status)
+	}
+
+	return nil
+}
+
+func (n *Nextcloud) comment(ctx context.Context, fileID string, message string) error {
+	body, _ := json.Marshal(map[string]any{
+		"actorType": "users",
+		"verb":      "comment",
+		"message":   message,
+	})
+
+	resp, err := n.request(ctx, "POST", n.rootURL("/remote.php/dav/comments/files/"+fileID), http.Header{"Content-Type": {"application/json"}}, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to post comment: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unable to post comment: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// shareLink creates a public link share using the OCS share API
+func (n *Nextcloud) shareLink(ctx context.Context, remotePath string) (string, error) {
+	form := url.Values{
+		"path":      {"/" + remotePath},
+		"shareType": {"3"},
+	}
+	if n.ShareExpiry > 0 {
+		form.Set("expireDate", time.Now().Add(n.ShareExpiry).Format("2006-01-02"))
+	}
+
+	resp, err := n.request(ctx, "POST", n.rootURL("/ocs/v2.php/apps/files_sharing/api/v1/shares?format=json"), http.Header{
+		"Content-Type":   {"application/x-www-form-urlencoded"},
+		"OCS-APIRequest": {"true"},
+	}, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("unable to create share: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to create share: %s, %s", resp.Status, string(body))
+	}
+
+	var share struct {
+		OCS struct {
+			Data struct {
+				URL string `json:"url"`
+			} `json:"data"`
+		} `json:"ocs"`
+	}
+	err = json.Unmarshal(body, &share)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse share: %w", err)
+	}
+
+	return share.OCS.Data.URL, nil
+}
+
+// tags returns the system tags for a classification
+func (n *Nextcloud) tags(classification Classification) []string {
+	tags := []string{classification.Category}
+	if classification.Sender != "" {
+		tags = append(tags, classification.Sender)
+	}
+	if date, err := time.Parse("2006-01-02", classification.Date); err == nil {
+		tags = append(tags, date.Format("2006"))
+	}
+	tags = append(tags, classification.Tags...)
+
+	return tags
+}
+
+// StoreFile uploads the file via WebDAV and enriches it. The file is already stored when
+// enrichment fails, so those errors are only logged.
+func (n *Nextcloud) StoreFile(ctx context.Context, data []byte, classification Classification) (StoredFile, error) {
+	stored, err := n.WebDAV.StoreFile(ctx, data, classification)
+	if err != nil || stored.Duplicate {
+		return stored, err
+	}
+
+	if !n.Tags && !n.Comment && !n.ShareLink {
+		return stored, nil
+	}
+
+	fileID, err := n.fileID(ctx, stored.Path)
+	if err != nil {
+		slog.Warn("Unable to get Nextcloud file id, skipping enrichment", "path", stored.Path, "error", err)
+		return stored, nil
+	}
+
+	if n.Tags {
+		for _, tag := range n.tags(classification) {
+			err = n.assignTag(ctx, fileID, tag)
+			if err != nil {
+				slog.Warn("Unable to assign Nextcloud tag", "tag", tag, "error", err)
+			}
+		}
+	}
+
+	if n.Comment && classification.Explanation != "" {
+		err = n.comment(ctx, fileID, classification.Explanation)
+		if err != nil {
+			slog.Warn("Unable to post Nextcloud comment", "error", err)
+		}
+	}
+
+	if n.ShareLink {
+		link, err := n.shareLink(ctx, stored.Path)
+		if err != nil {
+			slog.Warn("Unable to create Nextcloud share link", "error", err)
+		} else {
+			stored.URL = link
+		}
+	}
+
+	return stored, nil
+}
@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Paperless stores documents in a Paperless-ngx instance
+type Paperless struct {
+	URL   string
+	Token string
+
+	// CategoryAs is either "document_type" or "tag" and decides what the
+	// classification category is mapped to
+	CategoryAs string
+
+	// Tags are assigned to every document in addition to the category
+	Tags []string
+
+	// PollInterval and PollTimeout control how long to wait for the consume task
+	PollInterval time.Duration
+	PollTimeout  time.Duration
+}
+
+type paperlessList struct {
+	Count   int `json:"count"`
+	Results []struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	} `json:"results"`
+}
+
+type paperlessTask struct {
+	Status          string  `json:"status"`
+	Result          *string `json:"result"`
+	RelatedDocument *string `json:"related_document"`
+}
+
+func (p *Paperless) do(ctx context.Context, method string, path string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(p.URL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Token "+p.Token)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+// getOrCreate looks up an object (correspondent, document type, tag) by name and creates it if it doesn't exist
+func (p *Paperless) getOrCreate(ctx context.Context, kind string, name string) (int, error) {
+	resp, err := p.do(ctx, "GET", fmt.Sprintf("/api/%s/?name__iexact=%s", kind, url.QueryEscape(name)), "", nil)
+	if err != nil {
+		return 0, fmt.Errorf("unable to list %s: %w", kind, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unable to list %s: %s", kind, resp.Status)
+	}
+
+	var list paperlessList
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %s: %w", kind, err)
+	}
+
+	if len(list.Results) > 0 {
+		return list.Results[0].ID, nil
+	}
+
+	slog.Info("Creating Paperless object", "kind", kind, "name", name)
+
+	body, _ := json.Marshal(map[string]any{"name": name})
+	resp, err = p.do(ctx, "POST", fmt.Sprintf("/api/%s/", kind), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("unable to create %s: %w", kind, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		b, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("unable to create %s: %s, %s", kind, resp.Status, string(b))
+	}
+
+	var created struct {
+		ID int `json:"id"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse created %s: %w", kind, err)
+	}
+
+	return created.ID, nil
+}
+
+// waitForTask polls the consume task until paperless has created the document and returns its ID
+func (p *Paperless) waitForTask(ctx context.Context, taskID string) (string, error) {
+	interval := p.PollInterval
+	if interval == 0 {
+		interval = 2 * time.Second
+	}
+	timeout := p.PollTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		resp, err := p.do(ctx, "GET", "/api/tasks/?task_id="+url.QueryEscape(taskID), "", nil)
+		if err != nil {
+			return "", fmt.Errorf("unable to get task: %w", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return "", fmt.Errorf("unable to get task: %s, %s", resp.Status, string(b))
+		}
+
+		var tasks []paperlessTask
+		err = json.NewDecoder(resp.Body).Decode(&tasks)
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("unable to parse task: %w", err)
+		}
+
+		if len(tasks) > 0 {
+			task := tasks[0]
+			slog.Debug("Paperless task", "task", taskID, "status", task.Status)
+
+			switch task.Status {
+			case "SUCCESS":
+				if task.RelatedDocument == nil {
+					return "", errors.New("paperless task succeeded without a document")
+				}
+				return *task.RelatedDocument, nil
+			case "FAILURE", "REVOKED":
+				result := ""
+				if task.Result != nil {
+					result = *task.Result
+				}
+				return "", fmt.Errorf("paperless failed to consume document: %s", result)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+
+	return "", fmt.Errorf("timed out waiting for paperless task %s", taskID)
+}
+
+// findByChecksum returns the ID of a document with the same content, paperless stores MD5 checksums of originals
+func (p *Paperless) findByChecksum(ctx context.Context, data []byte) (int, bool, error) {
+	sum := md5.Sum(data)
+
+	resp, err := p.do(ctx, "GET", "/api/documents/?checksum__iexact="+hex.EncodeToString(sum[:]), "", nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to list documents: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, false, fmt.Errorf("unable to list documents: %s", resp.Status)
+	}
+
+	var list paperlessList
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to parse documents: %w", err)
+	}
+
+	if len(list.Results) == 0 {
+		return 0, false, nil
+	}
+
+	return list.Results[0].ID, true, nil
+}
+
+func (p *Paperless) documentURL(id string) string {
+	return fmt.Sprintf("%s/documents/%s/details", strings.TrimSuffix(p.URL, "/"), id)
+}
+
+// StoreFile posts a document to paperless. Paperless manages file names itself, so
+// only true duplicates are detected and skipped.
+func (p *Paperless) StoreFile(ctx context.Context, data []byte, classification Classification) (StoredFile, error) {
+	existing, ok, err := p.findByChecksum(ctx, data)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	if ok {
+		slog.Info("Document already exists in Paperless, skipping upload", "document", existing)
+		return StoredFile{Path: fmt.Sprintf("documents/%d", existing), URL: p.documentURL(strconv.Itoa(existing)), Duplicate: true}, nil
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	part, err := w.CreateFormFile("document", classification.FileName)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	_, err = part.Write(data)
+	if err != nil {
+		return StoredFile{}, err
+	}
+
+	w.WriteField("title", classification.Title)
+
+	if classification.Date != "" {
+		w.WriteField("created", classification.Date)
+	}
+
+	if classification.Sender != "" {
+		id, err := p.getOrCreate(ctx, "correspondents", classification.Sender)
+		if err != nil {
+			return StoredFile{}, err
+		}
+		w.WriteField("correspondent", strconv.Itoa(id))
+	}
+
+	// an empty category would create a nameless tag or document type
+	if classification.Category != "" {
+		if p.CategoryAs == "tag" {
+			id, err := p.getOrCreate(ctx, "tags", classification.Category)
+			if err != nil {
+				return StoredFile{}, err
+			}
+			w.WriteField("tags", strconv.Itoa(id))
+		} else {
+			id, err := p.getOrCreate(ctx, "document_types", classification.Category)
+			if err != nil {
+				return StoredFile{}, err
+			}
+			w.WriteField("document_type", strconv.Itoa(id))
+		}
+	}
+
+	for _, tag := range slices.Concat(p.Tags, classification.Tags) {
+		id, err := p.getOrCreate(ctx, "tags", tag)
+		if err != nil {
+			return StoredFile{}, err
+		}
+		w.WriteField("tags", strconv.Itoa(id))
+	}
+
+	err = w.Close()
+	if err != nil {
+		return StoredFile{}, err
+	}
+
+	resp, err := p.do(ctx, "POST", "/api/documents/post_document/", w.FormDataContentType(), &body)
+	if err != nil {
+		return StoredFile{}, fmt.Errorf("unable to post document: %w", err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return StoredFile{}, fmt.Errorf("unable to post document: %s, %s", resp.Status, string(b))
+	}
+
+	// post_document returns the UUID of the consume task as a JSON string
+	var taskID string
+	err = json.Unmarshal(b, &taskID)
+	if err != nil {
+		return StoredFile{}, fmt.Errorf("unable to parse task id: %w", err)
+	}
+
+	slog.Info("Posted document to Paperless", "task", taskID)
+
+	documentID, err := p.waitForTask(ctx, taskID)
+	if err != nil {
+		return StoredFile{}, err
+	}
+
+	return StoredFile{Path: "documents/" + documentID, URL: p.documentURL(documentID)}, nil
+}
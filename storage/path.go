@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PathData is passed to destination path templates
+type PathData struct {
+	Classification
+	// User is the user whose folder the scan came from
+	User string
+	// Date is the date of the document, or today if it is unknown
+	Date  string
+	Year  string
+	Month string
+	Day   string
+	Now   time.Time
+}
+
+// PathTemplate renders the destination path of a document. Category templates take precedence over Default.
+type PathTemplate struct {
+	Default    string
+	Categories map[string]string
+	User       string
+	// Folder is prepended to the rendered path, e.g. _duplicates
+	Folder string
+	// Override replaces all other templates, e.g. the destination of a rule
+	Override string
+}
+
+var transliterations = strings.NewReplacer(
+	"ä", "ae", "ö", "oe", "ü", "ue", "Ä", "Ae", "Ö", "Oe", "Ü", "Ue", "ß", "ss",
+	"é", "e", "è", "e", "ê", "e", "á", "a", "à", "a", "ç", "c", "ñ", "n",
+)
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// transliterate replaces umlauts and common accented characters with ASCII
+func transliterate(s string) string {
+	return transliterations.Replace(s)
+}
+
+// slugify turns s into a lowercase, dash separated ASCII string
+func slugify(s string) string {
+	s = strings.ToLower(transliterate(s))
+	return strings.Trim(nonSlugChars.ReplaceAllString(s, "-"), "-")
+}
+
+var pathFuncs = template.FuncMap{
+	"slugify":       slugify,
+	"transliterate": transliterate,
+	"lower":         strings.ToLower,
+	"upper":         strings.ToUpper,
+}
+
+// separators replaces path separators in values, so only the template text adds directories
+var separators = strings.NewReplacer("/", "-")
+
+// withoutSeparators removes the path separators from the values the LLM wrote, e.g. the sender "Müller/Schmidt GbR"
+func withoutSeparators(c Classification) Classification {
+	for _, field := range []*string{&c.Title, &c.Category, &c.Explanation, &c.FileName, &c.Sender, &c.Date, &c.Recipient} {
+		*field = separators.Replace(*field)
+	}
+
+	tags := make([]string, len(c.Tags))
+	for i, tag := range c.Tags {
+		tags[i] = separators.Replace(tag)
+	}
+	c.Tags = tags
+
+	return c
+}
+
+func newPathData(user string, classification Classification, now time.Time) PathData {
+	classification = withoutSeparators(classification)
+
+	date, err := time.Parse("2006-01-02", classification.Date)
+	if err != nil {
+		date = now
+	}
+
+	return PathData{
+		Classification: classification,
+		User:           separators.Replace(user),
+		Date:           date.Format("2006-01-02"),
+		Year:           date.Format("2006"),
+		Month:          date.Format("01"),
+		Day:            date.Format("02"),
+		Now:            now,
+	}
+}
+
+// Render returns the destination path for a classification, falling back to fallback if no template is configured
+func (t PathTemplate) Render(classification Classification, fallback string) (string, error) {
+	text := fallback
+	if t.Default != "" {
+		text = t.Default
+	}
+	if category, ok := t.Categories[classification.Category]; ok && category != "" {
+		text = category
+	}
+	if t.Override != "" {
+		text = t.Override
+	}
+
+	tmpl, err := template.New("path").Funcs(pathFuncs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse path template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, newPathData(t.User, classification, time.Now()))
+	if err != nil {
+		return "", fmt.Errorf("unable to render path template: %w", err)
+	}
+
+	rendered := buf.String()
+	if t.Folder != "" {
+		rendered = t.Folder + "/" + rendered
+	}
+
+	// never let a template escape the destination root
+	var segments []string
+	for _, segment := range strings.Split(rendered, "/") {
+		segment = strings.TrimSpace(segment)
+		if segment == "" || segment == "." || segment == ".." {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("path template rendered an empty path for %s", classification.FileName)
+	}
+
+	return path.Join(segments...), nil
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Stadtwerke Köln", "stadtwerke-koeln"},
+		{"Müller & Söhne GmbH", "mueller-soehne-gmbh"},
+		{"  Straße 8 / 2. OG  ", "strasse-8-2-og"},
+		{"Café Señor", "cafe-senor"},
+		{"---", ""},
+	}
+
+	for _, test := range tests {
+		if got := slugify(test.in); got != test.want {
+			t.Errorf("slugify(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestPathTemplateRender(t *testing.T) {
+	classification := Classification{Title: "Beitrag 2024", Category: "insurance", FileName: "beitrag.pdf", Sender: "Techniker Krankenkasse", Date: "2024-05-02"}
+	year := time.Now().Format("2006")
+
+	tests := []struct {
+		name           string
+		template       PathTemplate
+		classification *Classification
+		fallback       string
+		want           string
+		err            string
+	}{
+		{
+			name:     "fallback",
+			fallback: "{{.Category}}/{{.FileName}}",
+			want:     "insurance/beitrag.pdf",
+		},
+		{
+			name:     "default",
+			template: PathTemplate{Default: "{{.User}}/{{.Year}}/{{.Month}}/{{.FileName}}", User: "alice"},
+			fallback: "{{.FileName}}",
+			want:     "alice/2024/05/beitrag.pdf",
+		},
+		{
+			name:     "category",
+			template: PathTemplate{Default: "{{.FileName}}", Categories: map[string]string{"insurance": "Versicherung/{{.Sender | slugify}}/{{.FileName}}"}},
+			want:     "Versicherung/techniker-krankenkasse/beitrag.pdf",
+		},
+		{
+			name:     "override",
+			template: PathTemplate{Default: "{{.FileName}}", Categories: map[string]string{"insurance": "Versicherung"}, Override: "tk/{{.Date}}.pdf"},
+			want:     "tk/2024-05-02.pdf",
+		},
+		{
+			name:     "folder",
+			template: PathTemplate{Default: "{{.Category}}/{{.FileName}}", Folder: "_duplicates"},
+			want:     "_duplicates/insurance/beitrag.pdf",
+		},
+		{
+			name:           "unknown date",
+			template:       PathTemplate{Default: "{{.Year}}/{{.FileName}}"},
+			classification: &Classification{FileName: "scan.pdf", Date: "unknown"},
+			want:           year + "/scan.pdf",
+		},
+		{
+			name:           "separators in values",
+			template:       PathTemplate{Default: "{{.Sender}}/{{.Title}}.pdf"},
+			classification: &Classification{Sender: "Müller/Schmidt GbR", Title: "Rechnung 1/2024"},
+			want:           "Müller-Schmidt GbR/Rechnung 1-2024.pdf",
+		},
+		{
+			name:           "parent directories",
+			template:       PathTemplate{Default: "../../{{.Category}}/./{{.FileName}}"},
+			classification: &Classification{Category: "..", FileName: "../../etc/passwd"},
+			want:           "..-..-etc-passwd",
+		},
+		{
+			name:           "empty",
+			template:       PathTemplate{Default: "{{.Category}}/{{.FileName}}"},
+			classification: &Classification{},
+			err:            "empty path",
+		},
+		{
+			name:     "invalid template",
+			template: PathTemplate{Default: "{{.Category"},
+			err:      "unable to parse path template",
+		},
+		{
+			name:     "unknown field",
+			template: PathTemplate{Default: "{{.Nope}}"},
+			err:      "unable to render path template",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := classification
+			if test.classification != nil {
+				c = *test.classification
+			}
+
+			got, err := test.template.Render(c, test.fallback)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("Render = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveCollision(t *testing.T) {
+	data := []byte("content")
+	// the first 8 hex digits of the SHA-256 of "content"
+	hashed := "scan_ed7002b4.pdf"
+
+	tests := []struct {
+		name      string
+		strategy  CollisionStrategy
+		taken     map[string]bool
+		same      map[string]bool
+		want      string
+		duplicate bool
+		err       error
+	}{
+		{name: "free", strategy: CollisionSuffix, want: "scan.pdf"},
+		{name: "same content", strategy: CollisionFail, taken: map[string]bool{"scan.pdf": true}, same: map[string]bool{"scan.pdf": true}, want: "scan.pdf", duplicate: true},
+		{name: "suffix", strategy: CollisionSuffix, taken: map[string]bool{"scan.pdf": true, "scan_2.pdf": true}, want: "scan_3.pdf"},
+		{name: "suffix duplicate", strategy: CollisionSuffix, taken: map[string]bool{"scan.pdf": true, "scan_2.pdf": true}, same: map[string]bool{"scan_2.pdf": true}, want: "scan_2.pdf", duplicate: true},
+		{name: "default is suffix", taken: map[string]bool{"scan.pdf": true}, want: "scan_2.pdf"},
+		{name: "hash", strategy: CollisionHash, taken: map[string]bool{"scan.pdf": true}, want: hashed},
+		{name: "hash duplicate", strategy: CollisionHash, taken: map[string]bool{"scan.pdf": true, hashed: true}, same: map[string]bool{hashed: true}, want: hashed, duplicate: true},
+		{name: "hash taken", strategy: CollisionHash, taken: map[string]bool{"scan.pdf": true, hashed: true}, want: "scan_2.pdf"},
+		{name: "fail", strategy: CollisionFail, taken: map[string]bool{"scan.pdf": true}, err: ErrFileExists},
+		{name: "free with unknown strategy", strategy: "rename", want: "scan.pdf"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exists := func(name string) (bool, bool, error) {
+				return test.taken[name], test.same[name], nil
+			}
+
+			got, duplicate, err := resolveCollision("scan.pdf", data, test.strategy, exists)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if got != test.want || duplicate != test.duplicate {
+				t.Errorf("resolveCollision = %q, %v, want %q, %v", got, duplicate, test.want, test.duplicate)
+			}
+		})
+	}
+
+	_, _, err := resolveCollision("scan.pdf", data, "rename", func(string) (bool, bool, error) { return true, false, nil })
+	if err == nil || !strings.Contains(err.Error(), "unknown collision strategy") {
+		t.Errorf("error with unknown strategy = %v", err)
+	}
+}
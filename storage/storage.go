@@ -1,14 +1,119 @@
 package storage
 
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
 type Classification struct {
 	Title       string `json:"title"`
 	Category    string `json:"category"`
 	Explanation string `json:"explanation"`
-    FileName    string `json:"filename"`
+	FileName    string `json:"filename"`
+	Sender      string `json:"sender"`
+	Date        string `json:"date"`
+	// Recipient is the person the document is addressed to, it is only asked for if routing is enabled
+	Recipient string `json:"recipient,omitempty"`
+	// Tags are additional labels, e.g. set by rules
+	Tags []string `json:"tags,omitempty"`
+}
+
+// StoredFile describes where a provider put a document
+type StoredFile struct {
+	// Path is the final path of the file after collision handling
+	Path string
+	URL  string
+	// Duplicate is true if the same content already existed and nothing was uploaded
+	Duplicate bool
 }
 
 type StorageProvider interface {
-    StoreFile([]byte, Classification) (string, error)
+	StoreFile(context.Context, []byte, Classification) (StoredFile, error)
+}
+
+// CollisionStrategy decides what happens if a different file with the same name already exists
+type CollisionStrategy string
+
+const (
+	// CollisionSuffix appends a numeric suffix, e.g. letter_2.pdf
+	CollisionSuffix CollisionStrategy = "suffix"
+	// CollisionHash appends a short content hash, e.g. letter_3fa2c1d0.pdf
+	CollisionHash CollisionStrategy = "hash"
+	// CollisionFail refuses to store the file
+	CollisionFail CollisionStrategy = "fail"
+)
+
+var ErrFileExists = errors.New("a different file with the same name already exists")
+
+// ParseCollisionStrategy checks a configured strategy, empty means CollisionSuffix
+func ParseCollisionStrategy(value string) (CollisionStrategy, error) {
+	switch strategy := CollisionStrategy(value); strategy {
+	case "":
+		return CollisionSuffix, nil
+	case CollisionSuffix, CollisionHash, CollisionFail:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown collision strategy %q, use %s, %s or %s", value, CollisionSuffix, CollisionHash, CollisionFail)
+	}
 }
 
+// existsFunc reports whether a name is taken and whether the existing file has the same content
+type existsFunc func(name string) (taken bool, same bool, err error)
 
+func withSuffix(name string, suffix string) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s_%s%s", strings.TrimSuffix(name, ext), suffix, ext)
+}
+
+// resolveCollision returns the name a file should be stored under and whether it is a duplicate of an existing file
+func resolveCollision(name string, data []byte, strategy CollisionStrategy, exists existsFunc) (string, bool, error) {
+	taken, same, err := exists(name)
+	if err != nil {
+		return "", false, err
+	}
+	if !taken {
+		return name, false, nil
+	}
+	if same {
+		return name, true, nil
+	}
+
+	strategy, err = ParseCollisionStrategy(string(strategy))
+	if err != nil {
+		return "", false, err
+	}
+
+	switch strategy {
+	case CollisionFail:
+		return "", false, fmt.Errorf("%w: %s", ErrFileExists, name)
+	case CollisionHash:
+		sum := sha256.Sum256(data)
+		candidate := withSuffix(name, hex.EncodeToString(sum[:])[:8])
+
+		taken, same, err := exists(candidate)
+		if err != nil {
+			return "", false, err
+		}
+		if !taken || same {
+			return candidate, same, nil
+		}
+		// extremely unlikely, fall back to numeric suffixes
+	}
+
+	for i := 2; ; i++ {
+		candidate := withSuffix(name, fmt.Sprint(i))
+
+		taken, same, err := exists(candidate)
+		if err != nil {
+			return "", false, err
+		}
+		if !taken || same {
+			return candidate, same, nil
+		}
+	}
+}
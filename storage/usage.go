@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Usage is the token usage and cost of a single LLM call
+type Usage struct {
+	User             string
+	JobID            int64
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	// Cost is in USD, computed from the configured price table
+	Cost float64
+}
+
+// UsageSummary is the usage of a user and model in a month
+type UsageSummary struct {
+	User             string  `json:"user"`
+	Month            string  `json:"month"`
+	Model            string  `json:"model"`
+	Calls            int     `json:"calls"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// RecordUsage stores the usage of an LLM call and returns what the user spent this month including it.
+// Both happen in one transaction, so concurrent calls see each other's cost.
+func RecordUsage(db *sql.DB, usage Usage) (float64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("unable to record usage: %w", err)
+	}
+	defer tx.Rollback()
+
+	insertSQL := `INSERT INTO usage (user, job_id, model, prompt_tokens, completion_tokens, cost) VALUES (?, ?, ?, ?, ?, ?)`
+
+	_, err = tx.Exec(insertSQL, usage.User, usage.JobID, usage.Model, usage.PromptTokens, usage.CompletionTokens, usage.Cost)
+	if err != nil {
+		return 0, fmt.Errorf("unable to record usage: %w", err)
+	}
+
+	total, err := MonthlyCost(tx, usage.User, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return total, tx.Commit()
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// MonthlyCost returns what a user spent in the month of t
+func MonthlyCost(db queryer, user string, t time.Time) (float64, error) {
+	var cost float64
+	err := db.QueryRow(`SELECT COALESCE(SUM(cost), 0) FROM usage WHERE user = ? AND strftime('%Y-%m', created_at) = ?`,
+		user, t.UTC().Format("2006-01")).Scan(&cost)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get monthly cost: %w", err)
+	}
+
+	return cost, nil
+}
+
+// MonthlyUsage returns the usage per user, month and model. Empty user and month (YYYY-MM) match everything.
+func MonthlyUsage(db *sql.DB, user string, month string) ([]UsageSummary, error) {
+	var conditions []string
+	var args []any
+	if user != "" {
+		conditions = append(conditions, "user = ?")
+		args = append(args, user)
+	}
+	if month != "" {
+		conditions = append(conditions, "strftime('%Y-%m', created_at) = ?")
+		args = append(args, month)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	selectSQL := fmt.Sprintf(`SELECT user, strftime('%%Y-%%m', created_at) AS month, model, COUNT(*), SUM(prompt_tokens), SUM(completion_tokens), SUM(cost)
+	              FROM usage %s GROUP BY user, month, model ORDER BY month DESC, user, model`, where)
+
+	rows, err := db.Query(selectSQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get usage: %w", err)
+	}
+	defer rows.Close()
+
+	summaries := []UsageSummary{}
+	for rows.Next() {
+		var s UsageSummary
+		err := rows.Scan(&s.User, &s.Month, &s.Model, &s.Calls, &s.PromptTokens, &s.CompletionTokens, &s.Cost)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, s)
+	}
+
+	return summaries, rows.Err()
+}
@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	DefaultWebDAVPathTemplate = `Documents/scans/{{.Category}}/{{.Now.Format "2006-01-02"}}_{{.FileName}}`
+	DefaultWebDAVLinkTemplate = `{{.URL}}`
+)
+
+// WebDAV stores documents on any WebDAV server (Nextcloud, ownCloud, Seafile, Apache mod_dav, rclone, ...)
+type WebDAV struct {
+	// URL is the root of the server, e.g. https://cloud.example.com
+	URL string
+	// BasePath is the collection all paths are relative to, e.g. /remote.php/dav/files/alice
+	BasePath string
+	Username string
+	Password string
+
+	// Path renders the remote path of a document relative to BasePath
+	Path PathTemplate
+	// LinkTemplate renders the link that is returned after uploading
+	LinkTemplate string
+
+	// Collision decides what happens if a different file already exists at the rendered path
+	Collision CollisionStrategy
+}
+
+// webdavLinkData is passed to the link template
+type webdavLinkData struct {
+	// BaseURL is the server root
+	BaseURL string
+	// URL is the full URL of the uploaded file
+	URL string
+	// Path is the remote path relative to BasePath
+	Path string
+	// FileID and ETag are taken from the response headers if the server sends them
+	FileID string
+	ETag   string
+}
+
+func renderTemplate(name string, text string, data any) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse %s template: %w", name, err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("unable to render %s template: %w", name, err)
+	}
+
+	return buf.String(), nil
+}
+
+// fileURL returns the escaped URL of a path relative to BasePath
+func (w *WebDAV) fileURL(remotePath string) string {
+	segments := strings.Split(strings.Trim(path.Join(w.BasePath, remotePath), "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return strings.TrimSuffix(w.URL, "/") + "/" + strings.Join(segments, "/")
+}
+
+func (w *WebDAV) do(ctx context.Context, method string, remotePath string, header http.Header, body io.Reader) (*http.Response, error) {
+	return w.request(ctx, method, w.fileURL(remotePath), header, body)
+}
+
+// request sends an authenticated request to an arbitrary URL on the server
+func (w *WebDAV) request(ctx context.Context, method string, url string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if w.Username != "" {
+		req.SetBasicAuth(w.Username, w.Password)
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+// Exists checks whether a path relative to BasePath exists using PROPFIND
+func (w *WebDAV) Exists(ctx context.Context, remotePath string) (bool, error) {
+	resp, err := w.do(ctx, "PROPFIND", remotePath, http.Header{"Depth": {"0"}}, nil)
+	if err != nil {
+		return false, fmt.Errorf("unable to send PROPFIND request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusMultiStatus, http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected PROPFIND status for %s: %s", remotePath, resp.Status)
+	}
+}
+
+// remoteFile holds the properties of an existing file, as far as the server reports them
+type remoteFile struct {
+	// Size is -1 if the server doesn't report it
+	Size int64
+	ETag string
+	// FileID and Checksums are only reported by Nextcloud and ownCloud
+	FileID    string
+	Checksums string
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop><d:getcontentlength/><d:getetag/><oc:fileid/><oc:checksums/></d:prop>
+</d:propfind>`
+
+// davMultistatus is the part of PROPFIND responses that is read, elements match regardless of namespace
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ID            string `xml:"id"`
+				FileID        string `xml:"fileid"`
+				DisplayName   string `xml:"display-name"`
+				ContentLength string `xml:"getcontentlength"`
+				ETag          string `xml:"getetag"`
+				Checksums     string `xml:"checksums>checksum"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// stat returns the properties of a file, or nil if it doesn't exist
+func (w *WebDAV) stat(ctx context.Context, remotePath string) (*remoteFile, error) {
+	header := http.Header{"Depth": {"0"}, "Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := w.do(ctx, "PROPFIND", remotePath, header, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, fmt.Errorf("unable to send PROPFIND request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusMultiStatus, http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected PROPFIND status for %s: %s", remotePath, resp.Status)
+	}
+
+	var ms davMultistatus
+	err = xml.NewDecoder(resp.Body).Decode(&ms)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse PROPFIND response for %s: %w", remotePath, err)
+	}
+
+	file := &remoteFile{Size: -1}
+	for _, response := range ms.Responses {
+		// properties the server doesn't know are reported empty in their own propstat
+		for _, propstat := range response.Propstat {
+			prop := propstat.Prop
+			if size, err := strconv.ParseInt(strings.TrimSpace(prop.ContentLength), 10, 64); err == nil {
+				file.Size = size
+			}
+			file.ETag = cmp.Or(strings.Trim(prop.ETag, `"`), file.ETag)
+			file.FileID = cmp.Or(prop.FileID, file.FileID)
+			file.Checksums = cmp.Or(prop.Checksums, file.Checksums)
+		}
+	}
+
+	return file, nil
+}
+
+// checksumsMatch compares data with the checksums Nextcloud stores, e.g. "SHA1:... MD5:...",
+// known is false if none of them can be compared
+func checksumsMatch(checksums string, data []byte) (match bool, known bool) {
+	for _, checksum := range strings.Fields(checksums) {
+		algorithm, value, ok := strings.Cut(checksum, ":")
+		if !ok {
+			continue
+		}
+
+		var sum []byte
+		switch strings.ToUpper(algorithm) {
+		case "SHA1":
+			s := sha1.Sum(data)
+			sum = s[:]
+		case "MD5":
+			s := md5.Sum(data)
+			sum = s[:]
+		case "SHA256":
+			s := sha256.Sum256(data)
+			sum = s[:]
+		default:
+			continue
+		}
+		return strings.EqualFold(value, hex.EncodeToString(sum)), true
+	}
+
+	return false, false
+}
+
+// sameContent checks whether a file exists and whether it has the same content as data. The
+// properties of the file are compared first, it is only downloaded if they can't tell.
+func (w *WebDAV) sameContent(ctx context.Context, remotePath string, data []byte) (*remoteFile, bool, error) {
+	file, err := w.stat(ctx, remotePath)
+	if err != nil || file == nil {
+		return nil, false, err
+	}
+
+	if file.Size >= 0 && file.Size != int64(len(data)) {
+		return file, false, nil
+	}
+	if match, known := checksumsMatch(file.Checksums, data); known {
+		return file, match, nil
+	}
+
+	resp, err := w.do(ctx, "GET", remotePath, nil, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to send GET request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("unexpected GET status for %s: %s", remotePath, resp.Status)
+	}
+
+	existing := sha256.New()
+	_, err = io.Copy(existing, resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to read %s: %w", remotePath, err)
+	}
+	sum := sha256.Sum256(data)
+	return file, bytes.Equal(existing.Sum(nil), sum[:]), nil
+}
+
+// MkdirAll creates a collection and all of its missing parents using MKCOL
+func (w *WebDAV) MkdirAll(ctx context.Context, dir string) error {
+	current := ""
+	for _, segment := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		current = path.Join(current, segment)
+
+		exists, err := w.Exists(ctx, current)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		slog.Debug("Creating WebDAV collection", "path", current)
+
+		resp, err := w.do(ctx, "MKCOL", current, nil, nil)
+		if err != nil {
+			return fmt.Errorf("unable to send MKCOL request: %w", err)
+		}
+		resp.Body.Close()
+
+		// 405 means the collection was created in the meantime
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("unable to create collection %s: %s", current, resp.Status)
+		}
+	}
+
+	return nil
+}
+
+func (w *WebDAV) StoreFile(ctx context.Context, data []byte, classification Classification) (StoredFile, error) {
+	remotePath, err := w.Path.Render(classification, DefaultWebDAVPathTemplate)
+	if err != nil {
+		return StoredFile{}, err
+	}
+
+	dir := path.Dir(remotePath)
+	err = w.MkdirAll(ctx, dir)
+	if err != nil {
+		return StoredFile{}, err
+	}
+
+	var existing *remoteFile
+	name, duplicate, err := resolveCollision(path.Base(remotePath), data, w.Collision, func(name string) (bool, bool, error) {
+		file, same, err := w.sameContent(ctx, path.Join(dir, name), data)
+		if same {
+			existing = file
+		}
+		return file != nil, same, err
+	})
+	if err != nil {
+		return StoredFile{}, err
+	}
+	remotePath = path.Join(dir, name)
+
+	if duplicate {
+		slog.Info("File already exists with the same content, skipping upload", "remotePath", remotePath)
+
+		link, err := w.link(remotePath, existing.FileID, existing.ETag)
+		if err != nil {
+			return StoredFile{}, err
+		}
+		return StoredFile{Path: remotePath, URL: link, Duplicate: true}, nil
+	}
+
+	slog.Debug("Uploading file via WebDAV", "remotePath", remotePath)
+
+	// Nextcloud stores the checksum, so later collisions are decided without downloading the file
+	sum := sha1.Sum(data)
+	header := http.Header{
+		"Content-Type": {"application/octet-stream"},
+		"Oc-Checksum":  {"SHA1:" + hex.EncodeToString(sum[:])},
+	}
+
+	resp, err := w.do(ctx, "PUT", remotePath, header, bytes.NewReader(data))
+	if err != nil {
+		return StoredFile{}, fmt.Errorf("unable to send PUT request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	slog.Debug("Response body", "body", string(body))
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return StoredFile{}, fmt.Errorf("unable to upload file: %s, %s", resp.Status, string(body))
+	}
+
+	slog.Info("Uploaded file via WebDAV", "remotePath", remotePath)
+
+	link, err := w.link(remotePath, resp.Header.Get("oc-fileid"), resp.Header.Get("oc-etag"))
+	if err != nil {
+		return StoredFile{}, err
+	}
+
+	return StoredFile{Path: remotePath, URL: link}, nil
+}
+
+// link renders the link template for a stored file
+func (w *WebDAV) link(remotePath string, fileID string, etag string) (string, error) {
+	linkTemplate := w.LinkTemplate
+	if linkTemplate == "" {
+		linkTemplate = DefaultWebDAVLinkTemplate
+	}
+
+	return renderTemplate("link", linkTemplate, webdavLinkData{
+		BaseURL: strings.TrimSuffix(w.URL, "/"),
+		URL:     w.fileURL(remotePath),
+		Path:    remotePath,
+		FileID:  fileID,
+		ETag:    etag,
+	})
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// gets counts the GET requests of all test servers, tests using it must not run in parallel
+var gets atomic.Int64
+
+// newTestWebDAV returns a provider for an in-memory WebDAV server below /dav
+func newTestWebDAV(t *testing.T, collision CollisionStrategy) (*WebDAV, webdav.FileSystem) {
+	t.Helper()
+
+	fs := webdav.NewMemFS()
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return &WebDAV{
+		URL:       server.URL,
+		BasePath:  "/dav",
+		Path:      PathTemplate{Default: "scans/{{.User}}/{{.Category}}/{{.FileName}}", User: "alice"},
+		Collision: collision,
+	}, fs
+}
+
+func readFile(t *testing.T, fs webdav.FileSystem, name string) string {
+	t.Helper()
+
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("open %s: %v", name, err)
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return string(b)
+}
+
+var testClassification = Classification{Category: "bank", FileName: "statement.pdf"}
+
+func TestWebDAVStoreFile(t *testing.T) {
+	w, fs := newTestWebDAV(t, CollisionSuffix)
+
+	stored, err := w.StoreFile(context.Background(), []byte("first"), testClassification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Path != "scans/alice/bank/statement.pdf" || stored.Duplicate {
+		t.Errorf("stored = %+v", stored)
+	}
+	if want := w.URL + "/dav/scans/alice/bank/statement.pdf"; stored.URL != want {
+		t.Errorf("URL = %q, want %q", stored.URL, want)
+	}
+
+	// all parent collections were created with MKCOL
+	for _, dir := range []string{"/scans", "/scans/alice", "/scans/alice/bank"} {
+		info, err := fs.Stat(context.Background(), dir)
+		if err != nil || !info.IsDir() {
+			t.Errorf("collection %s missing: %v", dir, err)
+		}
+	}
+	if got := readFile(t, fs, "/scans/alice/bank/statement.pdf"); got != "first" {
+		t.Errorf("content = %q", got)
+	}
+}
+
+func TestWebDAVDuplicate(t *testing.T) {
+	w, fs := newTestWebDAV(t, CollisionSuffix)
+	w.LinkTemplate = "{{.BaseURL}}/apps/files/?file={{.Path}}"
+
+	_, err := w.StoreFile(context.Background(), []byte("same"), testClassification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := w.StoreFile(context.Background(), []byte("same"), testClassification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Duplicate || stored.Path != "scans/alice/bank/statement.pdf" {
+		t.Errorf("stored = %+v", stored)
+	}
+	if want := w.URL + "/apps/files/?file=scans/alice/bank/statement.pdf"; stored.URL != want {
+		t.Errorf("URL = %q, want %q", stored.URL, want)
+	}
+	if _, err := fs.Stat(context.Background(), "/scans/alice/bank/statement_2.pdf"); err == nil {
+		t.Error("duplicate was uploaded again")
+	}
+}
+
+func TestWebDAVCollision(t *testing.T) {
+	sum := sha256.Sum256([]byte("second"))
+
+	tests := []struct {
+		strategy CollisionStrategy
+		path     string
+		err      error
+	}{
+		{CollisionSuffix, "scans/alice/bank/statement_2.pdf", nil},
+		{CollisionHash, "scans/alice/bank/statement_" + hex.EncodeToString(sum[:])[:8] + ".pdf", nil},
+		{CollisionFail, "", ErrFileExists},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.strategy), func(t *testing.T) {
+			w, fs := newTestWebDAV(t, test.strategy)
+
+			_, err := w.StoreFile(context.Background(), []byte("first"), testClassification)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gets.Store(0)
+			stored, err := w.StoreFile(context.Background(), []byte("second"), testClassification)
+			if n := gets.Load(); n != 0 {
+				t.Errorf("%d GET requests, files of a different size must not be downloaded", n)
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+
+			if stored.Path != test.path || stored.Duplicate {
+				t.Errorf("stored = %+v, want path %s", stored, test.path)
+			}
+			if got := readFile(t, fs, "/"+test.path); got != "second" {
+				t.Errorf("content = %q", got)
+			}
+			if got := readFile(t, fs, "/scans/alice/bank/statement.pdf"); got != "first" {
+				t.Errorf("original was overwritten: %q", got)
+			}
+		})
+	}
+}
+
+func TestWebDAVUnknownCollisionStrategy(t *testing.T) {
+	w, _ := newTestWebDAV(t, "sufix")
+
+	_, err := w.StoreFile(context.Background(), []byte("first"), testClassification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.StoreFile(context.Background(), []byte("second"), testClassification)
+	if err == nil {
+		t.Error("unknown strategy was accepted")
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/spf13/viper"
+)
+
+// telegramConfigured reports whether a user can receive Telegram messages
+func telegramConfigured(user string) bool {
+	return viper.IsSet("telegram_token") && viper.IsSet(fmt.Sprintf("users.%s.telegram", user))
+}
+
+func sendTelegramMessage(user string, message string) error {
+	return sendTelegram(user, message, nil)
+}
+
+// sendTelegramQuestion sends a message with buttons, the answers are handled by listenTelegram
+func sendTelegramQuestion(user string, message string, keyboard *telego.InlineKeyboardMarkup) error {
+	return sendTelegram(user, message, keyboard)
+}
+
+func sendTelegram(user string, message string, keyboard *telego.InlineKeyboardMarkup) error {
+	if !viper.IsSet("telegram_token") {
+		return errors.New("Telegram token not set")
+	}
+
+	token := viper.GetString("telegram_token")
+
+	// get username from config
+	if !viper.IsSet(fmt.Sprintf("users.%s.telegram", user)) {
+		return errors.New("Telegram user not set")
+	}
+
+	telegramUser := viper.GetString(fmt.Sprintf("users.%s.telegram", user))
+
+	bot, err := telego.NewBot(token, telego.WithDefaultDebugLogger(), telego.WithHTTPClient(rateLimitedClient("telegram")))
+	if err != nil {
+		slog.Error("Error creating Telegram bot", "error", err)
+		return err
+	}
+
+	params := tu.Message(tu.Username(telegramUser), message).WithParseMode(telego.ModeHTML)
+	if keyboard != nil {
+		params = params.WithReplyMarkup(keyboard)
+	}
+
+	msg, err := bot.SendMessage(params)
+	if err != nil {
+		slog.Error("Error sending Telegram message", "error", err)
+		return err
+	}
+
+	slog.Info("Sent Telegram message", "message", msg)
+
+	return nil
+}
+
+// telegramBatch collects "New file" notifications so that a burst of scans becomes a single message per user
+type telegramBatch struct {
+	mu      sync.Mutex
+	pending map[string][]string
+	timers  map[string]*time.Timer
+}
+
+var newFiles = &telegramBatch{
+	pending: make(map[string][]string),
+	timers:  make(map[string]*time.Timer),
+}
+
+// add queues a file, the message is sent once no new file arrived for "telegram.coalesce_window"
+func (b *telegramBatch) add(user string, file string) {
+	if !telegramConfigured(user) {
+		return
+	}
+
+	viper.SetDefault("telegram.coalesce_window", 10*time.Second)
+	window := viper.GetDuration("telegram.coalesce_window")
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending[user] = append(b.pending[user], file)
+
+	if timer, ok := b.timers[user]; ok {
+		timer.Reset(window)
+		return
+	}
+	b.timers[user] = time.AfterFunc(window, func() {
+		b.flush(user)
+	})
+}
+
+// flush sends the pending files of a user
+func (b *telegramBatch) flush(user string) {
+	b.mu.Lock()
+	files := b.pending[user]
+	delete(b.pending, user)
+	if timer, ok := b.timers[user]; ok {
+		timer.Stop()
+		delete(b.timers, user)
+	}
+	b.mu.Unlock()
+
+	if len(files) == 0 {
+		return
+	}
+
+	if len(files) == 1 {
+		sendTelegramMessage(user, fmt.Sprintf("<b>New file: <code>%s</code></b>", html.EscapeString(files[0])))
+		return
+	}
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "<b>%d new files:</b>\n", len(files))
+	for _, file := range files {
+		fmt.Fprintf(&message, "\n<code>%s</code>", html.EscapeString(file))
+	}
+	sendTelegramMessage(user, message.String())
+}
+
+// flushAll sends all pending messages, e.g. on shutdown
+func (b *telegramBatch) flushAll() {
+	b.mu.Lock()
+	var users []string
+	for user := range b.pending {
+		users = append(users, user)
+	}
+	b.mu.Unlock()
+
+	for _, user := range users {
+		b.flush(user)
+	}
+}
+
+// telegramAnswerHandler handles a button press of a user. The callback data of buttons is
+// "<handler>:<args...>" separated by colons, the returned text is shown to the user.
+type telegramAnswerHandler func(db *sql.DB, user string, args []string) (string, error)
+
+var telegramAnswerHandlers = map[string]telegramAnswerHandler{
+	"duplicate":    answerDuplicate,
+	"confirm":      answerConfirm,
+	"recategorize": answerRecategorize,
+	"category":     answerCategory,
+}
+
+// telegramUser returns the configured user with the given Telegram username
+func telegramUser(username string) (string, bool) {
+	for user := range viper.GetStringMap("users") {
+		configured := strings.TrimPrefix(viper.GetString(fmt.Sprintf("users.%s.telegram", user)), "@")
+		if configured != "" && strings.EqualFold(configured, username) {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// listenTelegram receives answers to questions sent with sendTelegramQuestion until ctx is cancelled
+func listenTelegram(ctx context.Context, db *sql.DB) {
+	if !viper.IsSet("telegram_token") {
+		return
+	}
+
+	bot, err := telego.NewBot(viper.GetString("telegram_token"), telego.WithDefaultLogger(false, true))
+	if err != nil {
+		slog.Error("Error creating Telegram bot", "error", err)
+		return
+	}
+
+	updates, err := bot.UpdatesViaLongPolling(&telego.GetUpdatesParams{
+		AllowedUpdates: []string{"callback_query"},
+	}, telego.WithLongPollingContext(ctx))
+	if err != nil {
+		slog.Error("Error receiving Telegram updates", "error", err)
+		return
+	}
+
+	slog.Info("Listening for Telegram answers")
+
+	for update := range updates {
+		if update.CallbackQuery == nil {
+			continue
+		}
+		query := update.CallbackQuery
+
+		answer := handleTelegramAnswer(db, query.From.Username, query.Data)
+
+		err := bot.AnswerCallbackQuery(tu.CallbackQuery(query.ID).WithText(answer))
+		if err != nil {
+			slog.Warn("Error answering Telegram callback", "error", err)
+		}
+
+		// questions are answered once, remove the buttons
+		if query.Message != nil {
+			_, err = bot.EditMessageReplyMarkup(&telego.EditMessageReplyMarkupParams{
+				ChatID:    tu.ID(query.Message.GetChat().ID),
+				MessageID: query.Message.GetMessageID(),
+			})
+			if err != nil {
+				slog.Warn("Error removing Telegram buttons", "error", err)
+			}
+		}
+	}
+
+	slog.Info("Stopped listening for Telegram answers")
+}
+
+func handleTelegramAnswer(db *sql.DB, username string, data string) string {
+	user, ok := telegramUser(username)
+	if !ok {
+		slog.Warn("Telegram answer from unknown user", "username", username)
+		return "Unknown user"
+	}
+
+	parts := strings.Split(data, ":")
+	handler, ok := telegramAnswerHandlers[parts[0]]
+	if !ok {
+		slog.Warn("Unknown Telegram answer", "user", user, "data", data)
+		return "Unknown answer"
+	}
+
+	text, err := handler(db, user, parts[1:])
+	if err != nil {
+		slog.Error("Error handling Telegram answer", "user", user, "data", data, "error", err)
+		return err.Error()
+	}
+
+	return text
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/spf13/viper"
+)
+
+// PDFs that were not scanned, e.g. from emails and downloads, already contain text. It is used
+// instead of OCR if it looks good enough, configured globally and per user folder:
+//
+//	text_layer:
+//	  mode: auto                 # auto, ocr (always OCR) or text (never OCR)
+//	  min_chars_per_page: 200
+//	  min_word_ratio: 0.5
+//	  dictionary: /usr/share/dict/ngerman
+//	users:
+//	  alice:
+//	    text_layer:
+//	      mode: ocr
+const (
+	textLayerAuto = "auto"
+	textLayerOCR  = "ocr"
+	textLayerText = "text"
+)
+
+// textQuality describes the text layer of a PDF
+type textQuality struct {
+	Pages        int
+	EmptyPages   int
+	CharsPerPage float64
+	// WordRatio is the share of words found in the dictionary, or that look like words without one
+	WordRatio float64
+}
+
+var (
+	dictionaryMutex sync.Mutex
+	dictionaries    = make(map[string]map[string]bool)
+)
+
+// dictionary returns the words of a word list with one word per line, nil if it can't be read
+func dictionary(path string) map[string]bool {
+	dictionaryMutex.Lock()
+	defer dictionaryMutex.Unlock()
+
+	if words, ok := dictionaries[path]; ok {
+		return words
+	}
+
+	var words map[string]bool
+	f, err := os.Open(path)
+	if err != nil {
+		slog.Warn("Dictionary not available, judging text layers without it", "dictionary", path, "error", err)
+	} else {
+		defer f.Close()
+
+		words = make(map[string]bool)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			words[strings.ToLower(strings.TrimSpace(scanner.Text()))] = true
+		}
+		if err := scanner.Err(); err != nil {
+			slog.Warn("Error reading dictionary", "dictionary", path, "error", err)
+		}
+	}
+
+	dictionaries[path] = words
+	return words
+}
+
+// looksLikeWord is used without dictionary, broken encodings produce tokens without vowels
+func looksLikeWord(token string) bool {
+	for _, r := range token {
+		if strings.ContainsRune("aeiouyäöüéèáàó", unicode.ToLower(r)) {
+			return true
+		}
+	}
+	return false
+}
+
+// measureText judges the text of the pages of a PDF, tokens without letters like amounts and
+// dates don't count towards the word ratio
+func measureText(pages []string, words map[string]bool) textQuality {
+	q := textQuality{Pages: len(pages)}
+
+	var chars, tokens, known int
+	for _, page := range pages {
+		n := 0
+		for _, r := range page {
+			if !unicode.IsSpace(r) {
+				n++
+			}
+		}
+		if n == 0 {
+			q.EmptyPages++
+		}
+		chars += n
+
+		for _, field := range strings.Fields(page) {
+			token := strings.TrimFunc(field, func(r rune) bool {
+				return !unicode.IsLetter(r)
+			})
+			if len([]rune(token)) < 2 {
+				continue
+			}
+
+			tokens++
+			word := looksLikeWord(token)
+			if words != nil {
+				word = words[strings.ToLower(token)]
+			}
+			if word {
+				known++
+			}
+		}
+	}
+
+	if q.Pages > 0 {
+		q.CharsPerPage = float64(chars) / float64(q.Pages)
+	}
+	if tokens > 0 {
+		q.WordRatio = float64(known) / float64(tokens)
+	}
+	return q
+}
+
+// good reports whether the text can replace OCR. Pages without text are usually scanned pages
+// in an otherwise digital PDF.
+func (q textQuality) good(user string) bool {
+	return q.Pages > 0 && q.EmptyPages == 0 &&
+		q.CharsPerPage >= viper.GetFloat64(userKey(user, "text_layer.min_chars_per_page")) &&
+		q.WordRatio >= viper.GetFloat64(userKey(user, "text_layer.min_word_ratio"))
+}
+
+// pdfText extracts the text layer of a PDF in reading order, pages are separated by form feeds like
+// the OCR text. -layout would pad columns with spaces that only cost tokens.
+func pdfText(ctx context.Context, file string) (string, error) {
+	output, err := exec.CommandContext(ctx, "pdftotext", "-enc", "UTF-8", file, "-").Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to extract text layer: %w", err)
+	}
+	return string(output), nil
+}
+
+// textLayer returns the text layer of a PDF if it makes OCR unnecessary for the user. The text and
+// the decision are recorded in fixtures, so replays need neither pdftotext nor the dictionary.
+func textLayer(ctx context.Context, file string, user string) (string, bool, error) {
+	viper.SetDefault("text_layer.mode", textLayerAuto)
+	viper.SetDefault("text_layer.min_chars_per_page", 200)
+	viper.SetDefault("text_layer.min_word_ratio", 0.5)
+	viper.SetDefault("text_layer.dictionary", "/usr/share/dict/ngerman")
+
+	mode := viper.GetString(userKey(user, "text_layer.mode"))
+	switch mode {
+	case textLayerOCR:
+		return "", false, nil
+	case textLayerAuto, textLayerText:
+	default:
+		return "", false, fmt.Errorf("invalid text layer mode %q", mode)
+	}
+
+	i, err := runLocal(interactionTextLayer, file, "", func(i *interaction) error {
+		text, err := pdfText(ctx, file)
+		if err != nil {
+			// OCR may still read damaged PDFs
+			slog.Warn("Error reading text layer, running OCR", "file", file, "error", err)
+			return nil
+		}
+
+		i.Text = text
+		if mode == textLayerText {
+			i.Usable = true
+			return nil
+		}
+
+		q := measureText(pageTexts(text), dictionary(viper.GetString(userKey(user, "text_layer.dictionary"))))
+		slog.Debug("Measured text layer", "file", file, "pages", q.Pages, "empty_pages", q.EmptyPages, "chars_per_page", q.CharsPerPage, "word_ratio", q.WordRatio)
+
+		i.Usable = q.good(user)
+		return nil
+	})
+
+	return i.Text, i.Usable, err
+}
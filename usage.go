@@ -0,0 +1,211 @@
+package main
+
+import (
+	"3nt3/ai-scan-classifier/storage"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/urfave/cli/v2"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// modelPrice is the price of a model in USD per million tokens
+type modelPrice struct {
+	Model      string  `mapstructure:"model"`
+	Prompt     float64 `mapstructure:"prompt"`
+	Completion float64 `mapstructure:"completion"`
+}
+
+// defaultPrices can be overridden and extended with the "prices" config, e.g. with a zero price
+// for local models:
+//
+//	prices:
+//	  - model: gpt-4
+//	    prompt: 30
+//	    completion: 60
+//	  - model: nomic-embed-text
+var defaultPrices = []modelPrice{
+	{Model: openai.GPT4, Prompt: 30, Completion: 60},
+	{Model: openai.GPT432K, Prompt: 60, Completion: 120},
+	{Model: "gpt-4-turbo", Prompt: 10, Completion: 30},
+	{Model: "gpt-4o", Prompt: 5, Completion: 15},
+	{Model: "gpt-4o-mini", Prompt: 0.15, Completion: 0.6},
+	{Model: openai.GPT3Dot5Turbo, Prompt: 0.5, Completion: 1.5},
+	{Model: "text-embedding-3-small", Prompt: 0.02},
+	{Model: "text-embedding-3-large", Prompt: 0.13},
+	{Model: "text-embedding-ada-002", Prompt: 0.1},
+}
+
+// price returns the price of a model, configured prices take precedence over the defaults
+func price(model string) (modelPrice, bool) {
+	var configured []modelPrice
+	err := viper.UnmarshalKey("prices", &configured)
+	if err != nil {
+		slog.Warn("Invalid price table", "error", err)
+	}
+
+	for _, prices := range [][]modelPrice{configured, defaultPrices} {
+		for _, p := range prices {
+			if p.Model == model {
+				return p, true
+			}
+		}
+	}
+
+	return modelPrice{}, false
+}
+
+// cost returns the cost of an LLM call in USD
+func cost(model string, usage openai.Usage) float64 {
+	p, ok := price(model)
+	if !ok {
+		slog.Warn("No price for model, cost is not tracked", "model", model)
+		return 0
+	}
+
+	return (float64(usage.PromptTokens)*p.Prompt + float64(usage.CompletionTokens)*p.Completion) / 1_000_000
+}
+
+// budget is the monthly LLM budget of a user in USD, zero means unlimited
+type budget struct {
+	// Soft switches to Model once it is exceeded
+	Soft float64
+	// Hard stops using the LLM and falls back to local classification
+	Hard  float64
+	Model string
+}
+
+func userBudget(user string) budget {
+	model := viper.GetString(fmt.Sprintf("users.%s.budget.model", user))
+	if model == "" {
+		model = openai.GPT3Dot5Turbo
+	}
+
+	return budget{
+		Soft:  viper.GetFloat64(fmt.Sprintf("users.%s.budget.soft", user)),
+		Hard:  viper.GetFloat64(fmt.Sprintf("users.%s.budget.hard", user)),
+		Model: model,
+	}
+}
+
+// model returns the model to use after spending the given amount this month, "" means the local fallback
+func (b budget) model(spent float64) string {
+	if b.Hard > 0 && spent >= b.Hard {
+		return ""
+	}
+	if b.Soft > 0 && spent >= b.Soft {
+		return b.Model
+	}
+	return classificationModel
+}
+
+// fallbackClassification files documents as misc under their original name when they can't be classified
+func fallbackClassification(file string) storage.Classification {
+	// images are converted, the uploaded file is always a PDF
+	name := strings.TrimSuffix(file, filepath.Ext(file))
+
+	return storage.Classification{
+		Title:       name,
+		Category:    "misc",
+		Explanation: "Not classified, the LLM was not available",
+		FileName:    name + ".pdf",
+	}
+}
+
+// recordUsage stores the usage of an LLM call and notifies the user if it exceeded a budget. The
+// monthly cost is read again, a job may make several calls and other workers spend concurrently.
+func recordUsage(db *sql.DB, job *storage.Job, model string, usage openai.Usage) {
+	c := cost(model, usage)
+
+	total, err := storage.RecordUsage(db, storage.Usage{
+		User:             job.User,
+		JobID:            job.ID,
+		Model:            model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		Cost:             c,
+	})
+	if err != nil {
+		slog.Error("Error recording usage", "job", job.ID, "error", err)
+		return
+	}
+
+	b := userBudget(job.User)
+	spent := total - c
+
+	var message string
+	if b.Hard > 0 && spent < b.Hard && total >= b.Hard {
+		message = fmt.Sprintf("<b>Monthly budget exhausted</b>\n\nYou spent $%.2f of your $%.2f budget. Documents are filed as misc without asking the LLM until next month.", total, b.Hard)
+	} else if b.Soft > 0 && spent < b.Soft && total >= b.Soft {
+		message = fmt.Sprintf("<b>Monthly budget reached</b>\n\nYou spent $%.2f of your $%.2f budget. Switching to %s until next month.", total, b.Soft, b.Model)
+	}
+
+	if message == "" {
+		return
+	}
+
+	slog.Warn("Budget exceeded", "user", job.User, "spent", total, "soft", b.Soft, "hard", b.Hard)
+	if telegramConfigured(job.User) {
+		sendTelegramMessage(job.User, message)
+	}
+}
+
+var usageCommand = &cli.Command{
+	Name:  "usage",
+	Usage: "Show the monthly token usage and cost per user and model",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "user",
+			Usage: "Only show the usage of this user",
+		},
+		&cli.StringFlag{
+			Name:  "month",
+			Usage: "Only show this month (YYYY-MM)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.IsSet("month") {
+			_, err := time.Parse("2006-01", c.String("month"))
+			if err != nil {
+				return fmt.Errorf("invalid month %s, use YYYY-MM", c.String("month"))
+			}
+		}
+
+		err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		db, err := storage.OpenDB(viperDatabase())
+		if err != nil {
+			slog.Error("Error opening database", "error", err)
+			return err
+		}
+		defer db.Close()
+
+		usage, err := storage.MonthlyUsage(db, c.String("user"), c.String("month"))
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "MONTH\tUSER\tMODEL\tCALLS\tPROMPT TOKENS\tCOMPLETION TOKENS\tCOST")
+
+		var total float64
+		for _, u := range usage {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t$%.4f\n", u.Month, u.User, u.Model, u.Calls, u.PromptTokens, u.CompletionTokens, u.Cost)
+			total += u.Cost
+		}
+		fmt.Fprintf(w, "\t\t\t\t\t\t$%.4f\n", total)
+
+		return w.Flush()
+	},
+}